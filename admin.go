@@ -2,52 +2,117 @@ package main
 
 import (
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type UnRegisteredChan chan Sentence
 type RegisteredChan chan Sentence
+type FallbackChan chan Sentence   // Lines of masks that failed to contextualise
+type QuarantineChan chan Sentence // Lines held back by quarantine rules
 
 type Administrator interface {
-	Administrate(chan Sentence) (UnRegisteredChan, RegisteredChan, error)
+	Administrate(chan Sentence) (UnRegisteredChan, RegisteredChan, FallbackChan, QuarantineChan, error)
 }
 
 type Admin struct {
-	maskStore    *MemoryStore[bool]
-	contextStore *MemoryStore[Context]
-	wg           *sync.WaitGroup
+	maskStore     *MemoryStore[MaskStatus]
+	contextStore  *MemoryStore[Context]
+	templateStore *MemoryStore[LogMask]
+	sampleLines   *MemoryStore[[]LogLine]
+	rules         Rules
+	dropped       atomic.Int64
+	wg            *sync.WaitGroup
 }
 
-func NewAdmin(maskStore *MemoryStore[bool], contextStore *MemoryStore[Context], wg *sync.WaitGroup) *Admin {
+func NewAdmin(maskStore *MemoryStore[MaskStatus], contextStore *MemoryStore[Context], templateStore *MemoryStore[LogMask], sampleLines *MemoryStore[[]LogLine], rules Rules, wg *sync.WaitGroup) *Admin {
 	return &Admin{
-		maskStore:    maskStore,
-		contextStore: contextStore,
-		wg:           wg,
+		maskStore:     maskStore,
+		contextStore:  contextStore,
+		templateStore: templateStore,
+		sampleLines:   sampleLines,
+		rules:         rules,
+		wg:            wg,
 	}
 }
 
-func (a *Admin) Administrate(input chan Sentence) (UnRegisteredChan, RegisteredChan, error) {
+// Dropped returns how many lines were discarded by drop rules
+func (a *Admin) Dropped() int64 {
+	return a.dropped.Load()
+}
+
+func (a *Admin) Administrate(input chan Sentence) (UnRegisteredChan, RegisteredChan, FallbackChan, QuarantineChan, error) {
 	unRegisteredChan := make(UnRegisteredChan, 100)
 	registeredChan := make(RegisteredChan, 100)
+	fallbackChan := make(FallbackChan, 100)
+	quarantineChan := make(QuarantineChan, 100)
 
 	go func() {
-		// Syncs with 2nd writer of registered chan in contextualiser
+		// Syncs with 2nd writer of registered and fallback chans in contextualiser
 		defer a.wg.Done()
 
-		// Safe to close unregistredChan since this is the only writer
+		// Safe to close unregistredChan and quarantineChan since this is the only writer
 		defer close(unRegisteredChan)
+		defer close(quarantineChan)
 
 		// Decided not to close all channels here as we want the caller to handle the closing of the channels
 		for s := range input {
-			key := string(s.Mask)
-			status, _ := a.maskStore.Get(key)
-			if status {
+			// Dropped and quarantined lines never reach the registry
+			if rule, matched := a.rules.Match(s); matched {
+				switch rule.Action {
+				case RuleDrop:
+					a.dropped.Add(1)
+					continue
+				case RuleQuarantine:
+					quarantineChan <- s
+					continue
+				case RulePriority:
+					s.Priority = true
+				}
+			}
+
+			// Counting the line in the same step as reading the state, so a mask the contextualiser
+			// has just moved on is never moved back
+			now := time.Now()
+			status, _ := a.maskStore.Update(s.Fingerprint, func(status MaskStatus, exists bool) (MaskStatus, bool) {
+				if !exists {
+					status.State = MaskCollecting
+				}
+
+				// Masks restored from a registry have not been seen by this run yet
+				if status.FirstSeen.IsZero() {
+					status.FirstSeen = now
+				}
+
+				status.Count++
+				status.LastSeen = now
+				return status, true
+			})
+
+			switch status.State {
+			case MaskRegistered:
 				registeredChan <- s
-			} else {
-				a.maskStore.Put(key, false)
+			case MaskFailed:
+				fallbackChan <- s
+			default:
+				// Remember which mask a new fingerprint stands for
+				if status.Count == 1 {
+					a.templateStore.Put(s.Fingerprint, s.Mask)
+				}
+
+				// Keep a few raw lines so the mask can be recomputed by a later mask version
+				a.sampleLines.Update(s.Fingerprint, func(lines []LogLine, _ bool) ([]LogLine, bool) {
+					if len(lines) >= keptSamples {
+						return lines, false
+					}
+
+					return append(lines, s.Line), true
+				})
+
 				unRegisteredChan <- s
 			}
 
 		}
 	}()
-	return unRegisteredChan, registeredChan, nil
+	return unRegisteredChan, registeredChan, fallbackChan, quarantineChan, nil
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -11,19 +12,23 @@ import (
 // AdminTestSuite provides test suite for Admin
 type AdminTestSuite struct {
 	suite.Suite
-	admin        *Admin
-	maskStore    *MemoryStore[bool]
-	contextStore *MemoryStore[Context]
-	wg           *sync.WaitGroup
-	helper       *TestHelper
+	admin         *Admin
+	maskStore     *MemoryStore[MaskStatus]
+	contextStore  *MemoryStore[Context]
+	templateStore *MemoryStore[LogMask]
+	sampleLines   *MemoryStore[[]LogLine]
+	wg            *sync.WaitGroup
+	helper        *TestHelper
 }
 
 func (suite *AdminTestSuite) SetupTest() {
-	suite.maskStore = NewMemoryStore()
+	suite.maskStore = NewMaskStatusStore()
 	suite.contextStore = NewContextStore()
+	suite.templateStore = NewTemplateStore()
+	suite.sampleLines = NewSampleLineStore()
 	// Create a fresh WaitGroup for each test
 	suite.wg = &sync.WaitGroup{}
-	suite.admin = NewAdmin(suite.maskStore, suite.contextStore, suite.wg)
+	suite.admin = NewAdmin(suite.maskStore, suite.contextStore, suite.templateStore, suite.sampleLines, nil, suite.wg)
 	suite.helper = &TestHelper{}
 }
 
@@ -32,6 +37,7 @@ func (suite *AdminTestSuite) TestNewAdmin() {
 	suite.NotNil(suite.admin)
 	suite.Equal(suite.maskStore, suite.admin.maskStore)
 	suite.Equal(suite.contextStore, suite.admin.contextStore)
+	suite.Equal(suite.templateStore, suite.admin.templateStore)
 	suite.Equal(suite.wg, suite.admin.wg)
 }
 
@@ -50,7 +56,7 @@ func (suite *AdminTestSuite) TestAdministrateUnregisteredMask() {
 	suite.wg.Add(1) // Admin will call Done() once
 
 	// Process through admin (mask is not pre-registered)
-	unRegistered, registered, err := suite.admin.Administrate(input)
+	unRegistered, registered, _, _, err := suite.admin.Administrate(input)
 	suite.NoError(err)
 
 	// Wait for processing to complete
@@ -66,11 +72,13 @@ func (suite *AdminTestSuite) TestAdministrateUnregisteredMask() {
 	suite.Len(unregisteredSentences, 1)
 	suite.Equal(testSentence, unregisteredSentences[0])
 
-	// Verify mask was added to store as false (unregistered)
-	maskKey := string(testSentence.Mask)
+	// Verify mask was added to store as collecting samples
+	maskKey := testSentence.Fingerprint
 	status, err := suite.maskStore.Get(maskKey)
 	suite.NoError(err)
-	suite.False(status)
+	suite.Equal(MaskCollecting, status.State)
+	suite.Equal(1, status.Count)
+	suite.False(status.FirstSeen.IsZero())
 
 	// Check that registered channel has no data (non-blocking check)
 	select {
@@ -82,14 +90,14 @@ func (suite *AdminTestSuite) TestAdministrateUnregisteredMask() {
 }
 
 func (suite *AdminTestSuite) TestAdministrateRegisteredMask() {
-	// Pre-register a mask as true (registered)
+	// Pre-register a mask
 	testSentence := suite.helper.CreateTestSentence(
 		"registered log line",
 		[]string{"registered", "log"},
 		"Y Y Y",
 	)
-	maskKey := string(testSentence.Mask)
-	suite.maskStore.Put(maskKey, true)
+	maskKey := testSentence.Fingerprint
+	suite.maskStore.Put(maskKey, MaskStatus{State: MaskRegistered})
 
 	// Create input channel
 	input := make(chan Sentence, 1)
@@ -99,7 +107,7 @@ func (suite *AdminTestSuite) TestAdministrateRegisteredMask() {
 	suite.wg.Add(1) // Admin will call Done() once
 
 	// Process through admin
-	unRegistered, registered, err := suite.admin.Administrate(input)
+	unRegistered, registered, _, _, err := suite.admin.Administrate(input)
 	suite.NoError(err)
 
 	// Wait for processing to complete
@@ -130,7 +138,7 @@ func (suite *AdminTestSuite) TestAdministrateMultipleSentences() {
 	sentence3 := suite.helper.CreateTestSentence("line3", []string{"line3"}, "Y3")
 
 	// Pre-register sentence2's mask
-	suite.maskStore.Put(string(sentence2.Mask), true)
+	suite.maskStore.Put(sentence2.Fingerprint, MaskStatus{State: MaskRegistered})
 
 	// Create input channel
 	input := make(chan Sentence, 3)
@@ -142,7 +150,7 @@ func (suite *AdminTestSuite) TestAdministrateMultipleSentences() {
 	suite.wg.Add(1) // Admin will call Done() once
 
 	// Process through admin
-	unRegistered, registered, err := suite.admin.Administrate(input)
+	unRegistered, registered, _, _, err := suite.admin.Administrate(input)
 	suite.NoError(err)
 
 	// Wait for processing to complete
@@ -178,7 +186,7 @@ func (suite *AdminTestSuite) TestAdministrateEmptyInput() {
 	suite.wg.Add(1) // Admin will call Done() once
 
 	// Process through admin
-	unRegistered, registered, err := suite.admin.Administrate(input)
+	unRegistered, registered, _, _, err := suite.admin.Administrate(input)
 	suite.NoError(err)
 
 	// Wait for processing to complete
@@ -209,12 +217,14 @@ func (suite *AdminTestSuite) TestChannelTypes() {
 
 	suite.wg.Add(1) // Admin will call Done() once
 
-	unRegistered, registered, err := suite.admin.Administrate(input)
+	unRegistered, registered, fallback, quarantine, err := suite.admin.Administrate(input)
 	suite.NoError(err)
 
 	// Verify channel types
 	suite.IsType((UnRegisteredChan)(nil), unRegistered)
 	suite.IsType((RegisteredChan)(nil), registered)
+	suite.IsType((FallbackChan)(nil), fallback)
+	suite.IsType((QuarantineChan)(nil), quarantine)
 
 	suite.wg.Wait()
 }
@@ -222,7 +232,7 @@ func (suite *AdminTestSuite) TestChannelTypes() {
 func (suite *AdminTestSuite) TestMaskStoreIntegration() {
 	// Test that Admin properly interacts with mask store
 	sentence := suite.helper.CreateTestSentence("test", []string{"test"}, "Y")
-	maskKey := string(sentence.Mask)
+	maskKey := sentence.Fingerprint
 
 	// Verify mask doesn't exist initially
 	_, err := suite.maskStore.Get(maskKey)
@@ -235,7 +245,7 @@ func (suite *AdminTestSuite) TestMaskStoreIntegration() {
 
 	suite.wg.Add(1)
 
-	unRegistered, _, err := suite.admin.Administrate(input)
+	unRegistered, _, _, _, err := suite.admin.Administrate(input)
 	suite.NoError(err)
 
 	suite.wg.Wait()
@@ -244,10 +254,99 @@ func (suite *AdminTestSuite) TestMaskStoreIntegration() {
 	for range unRegistered {
 	}
 
-	// Verify mask was added to store as false
+	// Verify mask was added to store as collecting samples
 	status, err := suite.maskStore.Get(maskKey)
 	suite.NoError(err)
-	suite.False(status)
+	suite.Equal(MaskCollecting, status.State)
+
+	// Verify the fingerprint can be traced back to its mask
+	mask, err := suite.templateStore.Get(maskKey)
+	suite.NoError(err)
+	suite.Equal(sentence.Mask, mask)
+
+	// Verify the raw line was kept as a sample
+	lines, err := suite.sampleLines.Get(maskKey)
+	suite.NoError(err)
+	suite.Equal([]LogLine{sentence.Line}, lines)
+}
+
+func (suite *AdminTestSuite) TestAdministrateCountsLines() {
+	sentence := suite.helper.CreateTestSentence("test", []string{"test"}, "Y")
+
+	input := make(chan Sentence, 3)
+	for i := 0; i < 3; i++ {
+		input <- sentence
+	}
+	close(input)
+
+	suite.wg.Add(1)
+	unRegistered, _, _, _, err := suite.admin.Administrate(input)
+	suite.NoError(err)
+	for range unRegistered {
+	}
+	suite.wg.Wait()
+
+	status, err := suite.maskStore.Get(sentence.Fingerprint)
+	suite.NoError(err)
+	suite.Equal(3, status.Count)
+	suite.False(status.LastSeen.Before(status.FirstSeen))
+}
+
+func (suite *AdminTestSuite) TestAdministrateFailedMaskTakesFallback() {
+	sentence := suite.helper.CreateTestSentence("test", []string{"test"}, "Y")
+	suite.maskStore.Put(sentence.Fingerprint, MaskStatus{State: MaskFailed, Failure: "timeout"})
+
+	input := make(chan Sentence, 1)
+	input <- sentence
+	close(input)
+
+	suite.wg.Add(1)
+	unRegistered, _, fallback, _, err := suite.admin.Administrate(input)
+	suite.NoError(err)
+	suite.wg.Wait()
+
+	suite.Empty(unRegistered)
+	suite.Equal(sentence, <-fallback)
+
+	// Failed masks keep their reason and are not collected again
+	status, err := suite.maskStore.Get(sentence.Fingerprint)
+	suite.NoError(err)
+	suite.Equal(MaskFailed, status.State)
+	suite.Equal("timeout", status.Failure)
+}
+
+func (suite *AdminTestSuite) TestAdministrateRules() {
+	rules, err := ParseRules(strings.NewReader("drop line heartbeat\nquarantine line password=\npriority mask ^Y Y$\n"))
+	suite.Require().NoError(err)
+	suite.admin = NewAdmin(suite.maskStore, suite.contextStore, suite.templateStore, suite.sampleLines, rules, suite.wg)
+
+	heartbeat := suite.helper.CreateTestSentence("heartbeat ok", []string{"heartbeat", "ok"}, "Y Y")
+	secret := suite.helper.CreateTestSentence("login password=hunter2", []string{"login", "password", "hunter2"}, "Y Y=Y")
+	urgent := suite.helper.CreateTestSentence("disk full", []string{"disk", "full"}, "Y Y")
+
+	input := make(chan Sentence, 3)
+	input <- heartbeat
+	input <- secret
+	input <- urgent
+	close(input)
+
+	suite.wg.Add(1)
+	unRegistered, _, _, quarantine, err := suite.admin.Administrate(input)
+	suite.NoError(err)
+	suite.wg.Wait()
+
+	suite.Equal(int64(1), suite.admin.Dropped())
+	suite.Equal(secret, <-quarantine)
+
+	// Only the priority line reaches the contextualiser, flagged as such
+	routed := <-unRegistered
+	suite.Equal(urgent.Line, routed.Line)
+	suite.True(routed.Priority)
+	suite.Empty(unRegistered)
+
+	// Dropped and quarantined masks never enter the registry
+	_, err = suite.maskStore.Get(secret.Fingerprint)
+	suite.Error(err)
 }
 
 func TestAdminTestSuite(t *testing.T) {
@@ -0,0 +1,589 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/gob"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Archives store lines as templates plus parameters, in the style of CLP. Every distinct mask is
+// kept once in the template dictionary and every distinct token once in the variable dictionary.
+// Lines of a template become a row in its token columns, one column per placeholder holding
+// variable IDs, and the order of lines is kept as one template number per line. Lines are rebuilt
+// with Render, so masks are never folded in an archive.
+//
+// On disk the dictionaries, the order and the columns of every template are separate gzipped gob
+// sections, located by an index at the end of the file, so a search only decompresses the
+// sections it needs:
+//
+//	magic | sections... | index | index offset (8 bytes, big endian)
+const archiveVersion = 2
+
+var archiveMagic = []byte("LGA\x00")
+
+type Archive struct {
+	Version   int
+	Templates []string     // Template dictionary, masks by template number
+	Variables []string     // Variable dictionary, tokens by variable ID
+	Columns   [][][]uint32 // Per template, one column of variable IDs per placeholder
+	Order     []uint32     // Template number of every line in input order
+}
+
+// archiveSection locates a section in an archive file
+type archiveSection struct {
+	Offset int64
+	Length int64
+}
+
+type archiveIndex struct {
+	Version   int
+	Templates archiveSection
+	Variables archiveSection
+	Order     archiveSection
+	Columns   []archiveSection // Per template
+}
+
+// ArchiveQuery selects lines by template ID, by a token value, or both
+type ArchiveQuery struct {
+	TemplateID string
+	Token      string
+}
+
+type ArchiveWriter struct {
+	consumer  *MaskConsumer
+	sentence  Sentence
+	templates map[Fingerprint]uint32
+	variables map[string]uint32
+	archive   Archive
+}
+
+func NewArchiveWriter() *ArchiveWriter {
+	return &ArchiveWriter{
+		consumer:  NewMaskConsumer(),
+		templates: make(map[Fingerprint]uint32),
+		variables: make(map[string]uint32),
+		archive:   Archive{Version: archiveVersion},
+	}
+}
+
+func (aw *ArchiveWriter) variable(token Token) uint32 {
+	value := string(token)
+	id, exists := aw.variables[value]
+	if !exists {
+		id = uint32(len(aw.archive.Variables))
+		aw.variables[value] = id
+		aw.archive.Variables = append(aw.archive.Variables, value)
+	}
+
+	return id
+}
+
+// Add appends a line to the archive
+func (aw *ArchiveWriter) Add(line []rune) error {
+	if err := aw.consumer.MaskInto(line, &aw.sentence); err != nil {
+		return err
+	}
+
+	template, exists := aw.templates[aw.sentence.Fingerprint]
+	if !exists {
+		template = uint32(len(aw.archive.Templates))
+		aw.templates[aw.sentence.Fingerprint] = template
+		aw.archive.Templates = append(aw.archive.Templates, string(aw.sentence.Mask))
+		aw.archive.Columns = append(aw.archive.Columns, make([][]uint32, len(aw.sentence.Tokens)))
+	}
+
+	columns := aw.archive.Columns[template]
+	for i, token := range aw.sentence.Tokens {
+		columns[i] = append(columns[i], aw.variable(token))
+	}
+
+	aw.archive.Order = append(aw.archive.Order, template)
+	return nil
+}
+
+func (aw *ArchiveWriter) Archive() *Archive {
+	return &aw.archive
+}
+
+// countingWriter tracks the offset of the next section
+type countingWriter struct {
+	w      io.Writer
+	offset int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.offset += int64(n)
+	return n, err
+}
+
+// section writes value as a gzipped gob and returns where it went
+func (cw *countingWriter) section(value interface{}) (archiveSection, error) {
+	start := cw.offset
+	compressor := gzip.NewWriter(cw)
+	if err := gob.NewEncoder(compressor).Encode(value); err != nil {
+		return archiveSection{}, err
+	}
+
+	if err := compressor.Close(); err != nil {
+		return archiveSection{}, err
+	}
+
+	return archiveSection{Offset: start, Length: cw.offset - start}, nil
+}
+
+// Write stores the archive as independently readable sections
+func (a *Archive) Write(w io.Writer) error {
+	out := &countingWriter{w: w}
+	if _, err := out.Write(archiveMagic); err != nil {
+		return err
+	}
+
+	index := archiveIndex{Version: archiveVersion}
+	var err error
+	if index.Templates, err = out.section(a.Templates); err != nil {
+		return err
+	}
+
+	if index.Variables, err = out.section(a.Variables); err != nil {
+		return err
+	}
+
+	if index.Order, err = out.section(a.Order); err != nil {
+		return err
+	}
+
+	for _, columns := range a.Columns {
+		section, err := out.section(columns)
+		if err != nil {
+			return err
+		}
+
+		index.Columns = append(index.Columns, section)
+	}
+
+	indexOffset := out.offset
+	if err := gob.NewEncoder(out).Encode(index); err != nil {
+		return err
+	}
+
+	return binary.Write(out, binary.BigEndian, indexOffset)
+}
+
+// ArchiveReader reads the sections of an archive on demand
+type ArchiveReader struct {
+	r     io.ReaderAt
+	index archiveIndex
+}
+
+func NewArchiveReader(r io.ReaderAt, size int64) (*ArchiveReader, error) {
+	magic := make([]byte, len(archiveMagic))
+	if _, err := r.ReadAt(magic, 0); err != nil || !bytes.Equal(magic, archiveMagic) {
+		return nil, fmt.Errorf("not an archive")
+	}
+
+	var footer [8]byte
+	if size < int64(len(archiveMagic)+len(footer)) {
+		return nil, fmt.Errorf("truncated archive")
+	}
+
+	if _, err := r.ReadAt(footer[:], size-int64(len(footer))); err != nil {
+		return nil, err
+	}
+
+	indexOffset := int64(binary.BigEndian.Uint64(footer[:]))
+	if indexOffset < int64(len(archiveMagic)) || indexOffset > size-int64(len(footer)) {
+		return nil, fmt.Errorf("truncated archive")
+	}
+
+	ar := &ArchiveReader{r: r}
+	indexReader := io.NewSectionReader(r, indexOffset, size-int64(len(footer))-indexOffset)
+	if err := gob.NewDecoder(indexReader).Decode(&ar.index); err != nil {
+		return nil, err
+	}
+
+	if ar.index.Version != archiveVersion {
+		return nil, fmt.Errorf("archive version %d, expected %d", ar.index.Version, archiveVersion)
+	}
+
+	return ar, nil
+}
+
+// read decompresses a single section into value
+func (ar *ArchiveReader) read(section archiveSection, value interface{}) error {
+	decompressor, err := gzip.NewReader(io.NewSectionReader(ar.r, section.Offset, section.Length))
+	if err != nil {
+		return err
+	}
+	defer decompressor.Close()
+
+	return gob.NewDecoder(decompressor).Decode(value)
+}
+
+func (ar *ArchiveReader) Templates() ([]string, error) {
+	var templates []string
+	return templates, ar.read(ar.index.Templates, &templates)
+}
+
+func (ar *ArchiveReader) Variables() ([]string, error) {
+	var variables []string
+	return variables, ar.read(ar.index.Variables, &variables)
+}
+
+func (ar *ArchiveReader) Order() ([]uint32, error) {
+	var order []uint32
+	return order, ar.read(ar.index.Order, &order)
+}
+
+// Columns returns the columns of a single template
+func (ar *ArchiveReader) Columns(template uint32) ([][]uint32, error) {
+	if int(template) >= len(ar.index.Columns) {
+		return nil, fmt.Errorf("template %d not in archive", template)
+	}
+
+	var columns [][]uint32
+	return columns, ar.read(ar.index.Columns[template], &columns)
+}
+
+// Archive reads every section
+func (ar *ArchiveReader) Archive() (*Archive, error) {
+	archive := &Archive{Version: ar.index.Version}
+	var err error
+	if archive.Templates, err = ar.Templates(); err != nil {
+		return nil, err
+	}
+
+	if archive.Variables, err = ar.Variables(); err != nil {
+		return nil, err
+	}
+
+	if archive.Order, err = ar.Order(); err != nil {
+		return nil, err
+	}
+
+	for template := range ar.index.Columns {
+		columns, err := ar.Columns(uint32(template))
+		if err != nil {
+			return nil, err
+		}
+
+		archive.Columns = append(archive.Columns, columns)
+	}
+
+	return archive, nil
+}
+
+func ReadArchive(r io.ReaderAt, size int64) (*Archive, error) {
+	reader, err := NewArchiveReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	return reader.Archive()
+}
+
+// renderRow rebuilds a single line from its template and row in the template's columns
+func renderRow(mask string, variables []string, columns [][]uint32, row int) (LogLine, error) {
+	tokens := make([]Token, len(columns))
+	for i, column := range columns {
+		tokens[i] = Token(variables[column[row]])
+	}
+
+	return Render(LogMask(mask), tokens)
+}
+
+func (a *Archive) row(template uint32, row int) (LogLine, error) {
+	return renderRow(a.Templates[template], a.Variables, a.Columns[template], row)
+}
+
+// each visits the lines selected by keep in input order, rendering only those lines
+func (a *Archive) each(keep func(template uint32, row int) bool, visit func(LogLine) error) error {
+	rows := make([]int, len(a.Templates))
+	for _, template := range a.Order {
+		row := rows[template]
+		rows[template]++
+
+		if !keep(template, row) {
+			continue
+		}
+
+		line, err := a.row(template, row)
+		if err != nil {
+			return err
+		}
+
+		if err := visit(line); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Decompress writes every line in input order
+func (a *Archive) Decompress(w io.Writer) error {
+	writer := bufio.NewWriter(w)
+	err := a.each(func(uint32, int) bool { return true }, func(line LogLine) error {
+		_, err := fmt.Fprintln(writer, string(line))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return writer.Flush()
+}
+
+// match is a line of a template selected by a search
+type match struct {
+	row  int
+	line LogLine
+}
+
+// Search writes the lines matching the query in input order. Only the template dictionary, the
+// variable dictionary and the columns of the selected templates are decompressed. The order is
+// only read when lines of more than one template match, and only matching lines are rendered.
+func (ar *ArchiveReader) Search(query ArchiveQuery, w io.Writer) error {
+	templates, err := ar.Templates()
+	if err != nil {
+		return err
+	}
+
+	variables, err := ar.Variables()
+	if err != nil {
+		return err
+	}
+
+	variable := -1
+	if query.Token != "" {
+		for id, value := range variables {
+			if value == query.Token {
+				variable = id
+				break
+			}
+		}
+
+		// A token that was never archived matches nothing
+		if variable < 0 {
+			return nil
+		}
+	}
+
+	// The order is read at most once, and only when it is needed
+	var order []uint32
+	readOrder := func() error {
+		if order != nil {
+			return nil
+		}
+
+		order, err = ar.Order()
+		return err
+	}
+
+	matches := make(map[uint32][]match)
+	for i, mask := range templates {
+		if query.TemplateID != "" && FingerprintOf(LogMask(mask)).String() != query.TemplateID {
+			continue
+		}
+
+		template := uint32(i)
+		columns, err := ar.Columns(template)
+		if err != nil {
+			return err
+		}
+
+		rows := 0
+		if len(columns) > 0 {
+			rows = len(columns[0])
+		} else if variable < 0 {
+			// Templates without placeholders only know their row count from the order
+			if err := readOrder(); err != nil {
+				return err
+			}
+
+			for _, t := range order {
+				if t == template {
+					rows++
+				}
+			}
+		}
+
+		for row := 0; row < rows; row++ {
+			if variable >= 0 && !rowHas(columns, row, uint32(variable)) {
+				continue
+			}
+
+			line, err := renderRow(mask, variables, columns, row)
+			if err != nil {
+				return err
+			}
+
+			matches[template] = append(matches[template], match{row: row, line: line})
+		}
+	}
+
+	writer := bufio.NewWriter(w)
+
+	// Rows of a single template are already in input order
+	if len(matches) <= 1 {
+		for _, selected := range matches {
+			for _, m := range selected {
+				if _, err := fmt.Fprintln(writer, string(m.line)); err != nil {
+					return err
+				}
+			}
+		}
+
+		return writer.Flush()
+	}
+
+	if err := readOrder(); err != nil {
+		return err
+	}
+
+	rows := make([]int, len(templates))
+	for _, template := range order {
+		row := rows[template]
+		rows[template]++
+
+		selected := matches[template]
+		if len(selected) == 0 || selected[0].row != row {
+			continue
+		}
+
+		if _, err := fmt.Fprintln(writer, string(selected[0].line)); err != nil {
+			return err
+		}
+		matches[template] = selected[1:]
+	}
+
+	return writer.Flush()
+}
+
+func rowHas(columns [][]uint32, row int, variable uint32) bool {
+	for _, column := range columns {
+		if column[row] == variable {
+			return true
+		}
+	}
+
+	return false
+}
+
+// runCompress implements the compress command
+func runCompress(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("compress", flag.ContinueOnError)
+	in := flags.String("in", "", "log `file` to compress")
+	to := flags.String("out", "", "archive `file` to write")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *in == "" || *to == "" {
+		return fmt.Errorf("compress: -in and -out are required")
+	}
+
+	lines, err := NewFileReader(*in).Read()
+	if err != nil {
+		return err
+	}
+
+	writer := NewArchiveWriter()
+	for line := range lines {
+		if err := writer.Add(line); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.Create(*to)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	archive := writer.Archive()
+	if err := archive.Write(file); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "archived %d lines as %d templates and %d variables\n", len(archive.Order), len(archive.Templates), len(archive.Variables))
+	return file.Close()
+}
+
+// openArchive opens an archive file, the caller closes it once done with the reader
+func openArchive(filename string) (*ArchiveReader, *os.File, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	reader, err := NewArchiveReader(file, info.Size())
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	return reader, file, nil
+}
+
+// runDecompress implements the decompress command
+func runDecompress(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("decompress", flag.ContinueOnError)
+	in := flags.String("in", "", "archive `file` to decompress")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *in == "" {
+		return fmt.Errorf("decompress: -in is required")
+	}
+
+	reader, file, err := openArchive(*in)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	archive, err := reader.Archive()
+	if err != nil {
+		return err
+	}
+
+	return archive.Decompress(out)
+}
+
+// runSearch implements the search command
+func runSearch(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("search", flag.ContinueOnError)
+	in := flags.String("in", "", "archive `file` to search")
+	var query ArchiveQuery
+	flags.StringVar(&query.TemplateID, "template", "", "only lines of the template with this `ID`")
+	flags.StringVar(&query.Token, "token", "", "only lines with a token equal to `value`")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *in == "" || (query.TemplateID == "" && query.Token == "") {
+		return fmt.Errorf("search: -in and one of -template or -token are required")
+	}
+
+	reader, file, err := openArchive(*in)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return reader.Search(query, out)
+}
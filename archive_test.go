@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// ArchiveTestSuite provides test suite for template archives
+type ArchiveTestSuite struct {
+	suite.Suite
+	helper *TestHelper
+	lines  []string
+}
+
+func (suite *ArchiveTestSuite) SetupTest() {
+	suite.helper = &TestHelper{}
+	suite.lines = []string{
+		"pid=1702 state=[ok]",
+		"user alice logged in",
+		"pid=1703 state=[ok]",
+		"",
+		"user bob logged in",
+		"pid=1702 state=[failed]",
+	}
+}
+
+func (suite *ArchiveTestSuite) archive(lines []string) *Archive {
+	writer := NewArchiveWriter()
+	for _, line := range lines {
+		suite.Require().NoError(writer.Add([]rune(line)))
+	}
+
+	return writer.Archive()
+}
+
+// reader writes the archive of lines to memory and opens it for searching
+func (suite *ArchiveTestSuite) reader(lines []string, r func(*bytes.Reader) io.ReaderAt) *ArchiveReader {
+	var file bytes.Buffer
+	suite.Require().NoError(suite.archive(lines).Write(&file))
+
+	content := bytes.NewReader(file.Bytes())
+	reader, err := NewArchiveReader(r(content), content.Size())
+	suite.Require().NoError(err)
+	return reader
+}
+
+func plainReader(r *bytes.Reader) io.ReaderAt {
+	return r
+}
+
+// trackingReader records the offsets read from an archive
+type trackingReader struct {
+	r    io.ReaderAt
+	read []int64
+}
+
+func (tr *trackingReader) ReadAt(p []byte, off int64) (int, error) {
+	tr.read = append(tr.read, off)
+	return tr.r.ReadAt(p, off)
+}
+
+// touched reports whether any read started inside the section
+func (tr *trackingReader) touched(section archiveSection) bool {
+	for _, off := range tr.read {
+		if off >= section.Offset && off < section.Offset+section.Length {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (suite *ArchiveTestSuite) TestDictionaries() {
+	archive := suite.archive(suite.lines)
+
+	suite.Equal([]string{"Y=Y Y=[X]", "Y Y Y Y", ""}, archive.Templates)
+	suite.Equal([]uint32{0, 1, 0, 2, 1, 0}, archive.Order)
+	suite.Len(archive.Columns[0], 4)
+	suite.Len(archive.Columns[0][0], 3)
+
+	// Repeated tokens share a variable
+	suite.Equal(archive.Columns[0][1][0], archive.Columns[0][1][2])
+}
+
+func (suite *ArchiveTestSuite) TestDecompressRestoresOrder() {
+	var out bytes.Buffer
+	suite.NoError(suite.archive(suite.lines).Decompress(&out))
+
+	suite.Equal(strings.Join(suite.lines, "\n")+"\n", out.String())
+}
+
+func (suite *ArchiveTestSuite) TestWriteReadRoundTrip() {
+	content, err := os.ReadFile(suite.helper.GetTestDataPath("sample.log"))
+	suite.Require().NoError(err)
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+
+	var file bytes.Buffer
+	suite.NoError(suite.archive(lines).Write(&file))
+
+	archive, err := ReadArchive(bytes.NewReader(file.Bytes()), int64(file.Len()))
+	suite.Require().NoError(err)
+
+	var out bytes.Buffer
+	suite.NoError(archive.Decompress(&out))
+	suite.Equal(strings.Join(lines, "\n")+"\n", out.String())
+}
+
+func (suite *ArchiveTestSuite) TestSearchByTemplate() {
+	archive := suite.reader(suite.lines, plainReader)
+
+	var out bytes.Buffer
+	query := ArchiveQuery{TemplateID: FingerprintOf(LogMask("Y Y Y Y")).String()}
+	suite.NoError(archive.Search(query, &out))
+
+	suite.Equal("user alice logged in\nuser bob logged in\n", out.String())
+}
+
+func (suite *ArchiveTestSuite) TestSearchReadsOnlyNeededSections() {
+	var tracking *trackingReader
+	archive := suite.reader(suite.lines, func(r *bytes.Reader) io.ReaderAt {
+		tracking = &trackingReader{r: r}
+		return tracking
+	})
+	tracking.read = nil
+
+	var out bytes.Buffer
+	query := ArchiveQuery{TemplateID: FingerprintOf(LogMask("Y Y Y Y")).String()}
+	suite.NoError(archive.Search(query, &out))
+
+	suite.True(tracking.touched(archive.index.Templates))
+	suite.True(tracking.touched(archive.index.Columns[1]))
+	suite.False(tracking.touched(archive.index.Columns[0]))
+	suite.False(tracking.touched(archive.index.Columns[2]))
+	suite.False(tracking.touched(archive.index.Order))
+}
+
+func (suite *ArchiveTestSuite) TestSearchEmptyTemplate() {
+	archive := suite.reader(suite.lines, plainReader)
+
+	var out bytes.Buffer
+	suite.NoError(archive.Search(ArchiveQuery{TemplateID: FingerprintOf(LogMask("")).String()}, &out))
+	suite.Equal("\n", out.String())
+}
+
+func (suite *ArchiveTestSuite) TestReadRejectsOtherFiles() {
+	_, err := NewArchiveReader(strings.NewReader("plain text log"), 14)
+	suite.Error(err)
+}
+
+func (suite *ArchiveTestSuite) TestSearchByToken() {
+	archive := suite.reader(suite.lines, plainReader)
+
+	var out bytes.Buffer
+	suite.NoError(archive.Search(ArchiveQuery{Token: "1702"}, &out))
+	suite.Equal("pid=1702 state=[ok]\npid=1702 state=[failed]\n", out.String())
+
+	out.Reset()
+	suite.NoError(archive.Search(ArchiveQuery{Token: "missing"}, &out))
+	suite.Empty(out.String())
+}
+
+func (suite *ArchiveTestSuite) TestSearchByTemplateAndToken() {
+	archive := suite.reader(suite.lines, plainReader)
+
+	var out bytes.Buffer
+	query := ArchiveQuery{TemplateID: FingerprintOf(LogMask("Y=Y Y=[X]")).String(), Token: "ok"}
+	suite.NoError(archive.Search(query, &out))
+
+	suite.Equal("pid=1702 state=[ok]\npid=1703 state=[ok]\n", out.String())
+}
+
+func (suite *ArchiveTestSuite) TestCommands() {
+	dir := suite.T().TempDir()
+	archiveFile := filepath.Join(dir, "sample.lga")
+
+	var out bytes.Buffer
+	suite.NoError(runCompress([]string{"-in", suite.helper.GetTestDataPath("malformed.log"), "-out", archiveFile}, &out))
+	suite.Contains(out.String(), "archived 6 lines")
+
+	out.Reset()
+	suite.NoError(runDecompress([]string{"-in", archiveFile}, &out))
+	content, err := os.ReadFile(suite.helper.GetTestDataPath("malformed.log"))
+	suite.NoError(err)
+	suite.Equal(strings.TrimSuffix(string(content), "\n")+"\n", out.String())
+
+	out.Reset()
+	suite.NoError(runSearch([]string{"-in", archiveFile, "-token", "unclosed"}, &out))
+	suite.Equal("Line with \"unclosed quotes\nMixed [content {with} unclosed\n", out.String())
+
+	suite.Error(runSearch([]string{"-in", archiveFile}, &out))
+}
+
+func TestArchiveTestSuite(t *testing.T) {
+	suite.Run(t, new(ArchiveTestSuite))
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Masks that differ by a stray symbol or an optional field are near-duplicates.
+// The clusterer measures an edit distance over mask units, where every placeholder
+// and every symbol counts as one unit, and proposes merging close masks into a
+// canonical one whose context is remapped onto the others.
+const unknownLabel = "unknown"
+
+type MergeProposal struct {
+	Canonical LogMask
+	Members   []LogMask // Near-duplicates of the canonical mask, excluding itself
+}
+
+type MaskClusterer struct {
+	threshold int
+}
+
+func NewMaskClusterer(threshold int) *MaskClusterer {
+	return &MaskClusterer{
+		threshold: threshold,
+	}
+}
+
+func isPlaceholder(r rune) bool {
+	return r == topLevelAlphaNumericContent || r == nestedContent
+}
+
+// substitutionCost never lets a placeholder stand in for a symbol, those pairs
+// are cheaper as a deletion plus an insertion
+func substitutionCost(a, b rune) int {
+	switch {
+	case a == b:
+		return 0
+	case isPlaceholder(a) != isPlaceholder(b):
+		return 2
+	default:
+		return 1
+	}
+}
+
+// editTable fills the edit distance table between two masks
+func editTable(a, b LogMask) [][]int {
+	table := make([][]int, len(a)+1)
+	for i := range table {
+		table[i] = make([]int, len(b)+1)
+		table[i][0] = i
+	}
+
+	for j := range table[0] {
+		table[0][j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			table[i][j] = min(
+				table[i-1][j]+1,
+				table[i][j-1]+1,
+				table[i-1][j-1]+substitutionCost(a[i-1], b[j-1]),
+			)
+		}
+	}
+
+	return table
+}
+
+// MaskDistance is the token-aware edit distance between two compressed masks
+func MaskDistance(a, b LogMask) int {
+	return editTable(a, b)[len(a)][len(b)]
+}
+
+// within reports whether two masks are within the threshold. Every unit of difference in length
+// costs at least one edit, so masks of too different lengths are rejected without a table.
+func (mc *MaskClusterer) within(a, b LogMask) (int, bool) {
+	if abs(len(a)-len(b)) > mc.threshold {
+		return 0, false
+	}
+
+	d := MaskDistance(a, b)
+	return d, d <= mc.threshold
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+
+	return n
+}
+
+// Propose groups masks that are within the threshold of each other. Masks are considered
+// in the given order and the first mask of each group becomes its canonical mask, so callers
+// should pass the masks they trust most (e.g. already contextualised) first.
+func (mc *MaskClusterer) Propose(masks []LogMask) []MergeProposal {
+	var proposals []MergeProposal
+	for _, mask := range masks {
+		merged := false
+		for i := range proposals {
+			if _, ok := mc.within(proposals[i].Canonical, mask); ok {
+				proposals[i].Members = append(proposals[i].Members, mask)
+				merged = true
+				break
+			}
+		}
+
+		if !merged {
+			proposals = append(proposals, MergeProposal{Canonical: mask})
+		}
+	}
+
+	// Only groups with members are worth merging
+	var results []MergeProposal
+	for _, p := range proposals {
+		if len(p.Members) > 0 {
+			results = append(results, p)
+		}
+	}
+
+	return results
+}
+
+// Nearest returns the closest candidate within the threshold
+func (mc *MaskClusterer) Nearest(mask LogMask, candidates []LogMask) (LogMask, bool) {
+	var best LogMask
+	var found bool
+	bestDistance := mc.threshold + 1
+	for _, c := range candidates {
+		if d, ok := mc.within(mask, c); ok && d < bestDistance {
+			best, bestDistance, found = c, d, true
+		}
+	}
+
+	return best, found
+}
+
+// RemapLabels carries labels from one mask onto a near-duplicate by aligning both masks.
+// Placeholders in the target without a counterpart in the source are labelled as unknown.
+func RemapLabels(from LogMask, labels []string, to LogMask) []string {
+	table := editTable(from, to)
+
+	// Walk the table back from the end, recording which source unit every target unit came from
+	source := make([]int, len(to))
+	for j := range source {
+		source[j] = -1
+	}
+
+	i, j := len(from), len(to)
+	for i > 0 && j > 0 {
+		switch {
+		case table[i][j] == table[i-1][j-1]+substitutionCost(from[i-1], to[j-1]):
+			source[j-1] = i - 1
+			i, j = i-1, j-1
+		case table[i][j] == table[i-1][j]+1:
+			i--
+		default:
+			j--
+		}
+	}
+
+	// Labels are ordered the same way as the placeholders of their mask
+	labelIndex := make(map[int]int)
+	var count int
+	for i, r := range from {
+		if isPlaceholder(r) {
+			labelIndex[i] = count
+			count++
+		}
+	}
+
+	var remapped []string
+	for j, r := range to {
+		if !isPlaceholder(r) {
+			continue
+		}
+
+		label := unknownLabel
+		if s := source[j]; s >= 0 && isPlaceholder(from[s]) && labelIndex[s] < len(labels) {
+			label = labels[labelIndex[s]]
+		}
+		remapped = append(remapped, label)
+	}
+
+	return remapped
+}
+
+// ProposeRegistry clusters every known symbol mask, preferring contextualised masks as canonical.
+// Literal templates of consumers that assign their own IDs are left out.
+func (mc *MaskClusterer) ProposeRegistry(templates *MemoryStore[LogMask], contextRegistry *MemoryStore[Context]) []MergeProposal {
+	keys := templates.Keys()
+	sort.Slice(keys, func(i, j int) bool {
+		_, iErr := contextRegistry.Get(keys[i])
+		_, jErr := contextRegistry.Get(keys[j])
+		if (iErr == nil) != (jErr == nil) {
+			return iErr == nil
+		}
+
+		return keys[i] < keys[j]
+	})
+
+	var masks []LogMask
+	for _, k := range keys {
+		if mask, err := templates.Get(k); err == nil && FingerprintOf(mask) == k {
+			masks = append(masks, mask)
+		}
+	}
+
+	return mc.Propose(masks)
+}
+
+// PrintProposals writes every proposal with the template IDs of its canonical mask and members
+func PrintProposals(proposals []MergeProposal, w io.Writer) {
+	for _, p := range proposals {
+		fmt.Fprintf(w, "near-duplicates of %s %q:", FingerprintOf(p.Canonical), string(p.Canonical))
+		for _, member := range p.Members {
+			fmt.Fprintf(w, " %s", FingerprintOf(member))
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// Merge registers every member of the proposal with the canonical context remapped onto it.
+// Members with a context of their own are left untouched.
+func (mc *MaskClusterer) Merge(p MergeProposal, maskRegistry *MemoryStore[MaskStatus], contextRegistry *MemoryStore[Context]) error {
+	canonical, err := contextRegistry.Get(FingerprintOf(p.Canonical))
+	if err != nil {
+		return fmt.Errorf("canonical mask has no context: %w", err)
+	}
+
+	for _, member := range p.Members {
+		key := FingerprintOf(member)
+		if _, err := contextRegistry.Get(key); err == nil {
+			continue
+		}
+
+		contextRegistry.Put(key, Context{labels: RemapLabels(p.Canonical, canonical.labels, member), mask: member})
+		registerMask(maskRegistry, key)
+	}
+
+	return nil
+}
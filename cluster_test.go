@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// MaskClustererTestSuite provides test suite for MaskClusterer
+type MaskClustererTestSuite struct {
+	suite.Suite
+	clusterer       *MaskClusterer
+	maskRegistry    *MemoryStore[MaskStatus]
+	contextRegistry *MemoryStore[Context]
+	templates       *MemoryStore[LogMask]
+}
+
+func (suite *MaskClustererTestSuite) SetupTest() {
+	suite.clusterer = NewMaskClusterer(1)
+	suite.maskRegistry = NewMaskStatusStore()
+	suite.contextRegistry = NewContextStore()
+	suite.templates = NewTemplateStore()
+}
+
+// register records a mask as seen, with a context when labels are given
+func (suite *MaskClustererTestSuite) register(mask string, labels ...string) Fingerprint {
+	key := FingerprintOf(LogMask(mask))
+	suite.templates.Put(key, LogMask(mask))
+	suite.maskRegistry.Put(key, MaskStatus{State: MaskCollecting})
+	if len(labels) > 0 {
+		suite.maskRegistry.Put(key, MaskStatus{State: MaskRegistered})
+		suite.contextRegistry.Put(key, Context{labels: labels})
+	}
+
+	return key
+}
+
+func (suite *MaskClustererTestSuite) TestMaskDistance() {
+	testCases := []struct {
+		name     string
+		a        string
+		b        string
+		expected int
+	}{
+		{"identical", "Y=Y, Y=Y", "Y=Y, Y=Y", 0},
+		{"stray quote", `Y=Y", Y=Y`, "Y=Y, Y=Y", 1},
+		{"placeholder kinds", `Y="X"`, `Y="Y"`, 1},
+		{"placeholder never replaces symbol", "Y=Y", "Y=,", 2},
+		{"optional field", "Y Y=Y, Y=Y", "Y Y=Y", 5},
+	}
+
+	for _, tc := range testCases {
+		suite.Run(tc.name, func() {
+			suite.Equal(tc.expected, MaskDistance(LogMask(tc.a), LogMask(tc.b)))
+			suite.Equal(tc.expected, MaskDistance(LogMask(tc.b), LogMask(tc.a)))
+		})
+	}
+}
+
+func (suite *MaskClustererTestSuite) TestProposeGroupsNearDuplicates() {
+	masks := []LogMask{
+		LogMask("Y: Y=Y, Y=Y"),
+		LogMask("Y Y Y"),
+		LogMask(`Y: Y=Y", Y=Y`),
+	}
+
+	proposals := suite.clusterer.Propose(masks)
+
+	suite.Len(proposals, 1)
+	suite.Equal(LogMask("Y: Y=Y, Y=Y"), proposals[0].Canonical)
+	suite.Equal([]LogMask{LogMask(`Y: Y=Y", Y=Y`)}, proposals[0].Members)
+}
+
+func (suite *MaskClustererTestSuite) TestNearest() {
+	candidates := []LogMask{LogMask("Y Y Y"), LogMask("Y=Y, Y=Y")}
+
+	nearest, found := suite.clusterer.Nearest(LogMask(`Y=Y", Y=Y`), candidates)
+	suite.True(found)
+	suite.Equal(LogMask("Y=Y, Y=Y"), nearest)
+
+	_, found = suite.clusterer.Nearest(LogMask("Y[X]"), candidates)
+	suite.False(found)
+}
+
+func (suite *MaskClustererTestSuite) TestNearestSkipsMasksOfOtherLengths() {
+	// A length difference over the threshold is never within it, so no table is needed
+	long := LogMask("Y=Y, Y=Y, Y=Y")
+	_, ok := suite.clusterer.within(LogMask("Y=Y, Y=Y"), long)
+	suite.False(ok)
+
+	d, ok := suite.clusterer.within(LogMask("Y=Y, Y=Y"), LogMask(`Y=Y", Y=Y`))
+	suite.True(ok)
+	suite.Equal(1, d)
+}
+
+func (suite *MaskClustererTestSuite) TestRemapLabelsStraySymbol() {
+	labels := []string{"key", "value", "other_key", "other_value"}
+
+	remapped := RemapLabels(LogMask("Y=Y, Y=Y"), labels, LogMask(`Y=Y", Y=Y`))
+
+	suite.Equal(labels, remapped)
+}
+
+func (suite *MaskClustererTestSuite) TestRemapLabelsMissingField() {
+	labels := []string{"level", "component", "key", "value"}
+
+	remapped := RemapLabels(LogMask("Y [X] Y=Y"), labels, LogMask("Y Y=Y"))
+	suite.Equal([]string{"level", "key", "value"}, remapped)
+
+	remapped = RemapLabels(LogMask("Y Y=Y"), []string{"level", "key", "value"}, LogMask("Y [X] Y=Y"))
+	suite.Equal([]string{"level", unknownLabel, "key", "value"}, remapped)
+}
+
+func (suite *MaskClustererTestSuite) TestProposeRegistryPrefersContextualisedMasks() {
+	suite.register(`Y=Y", Y=Y`)
+	suite.register("Y=Y, Y=Y", "a", "b", "c", "d")
+
+	proposals := suite.clusterer.ProposeRegistry(suite.templates, suite.contextRegistry)
+
+	suite.Len(proposals, 1)
+	suite.Equal(LogMask("Y=Y, Y=Y"), proposals[0].Canonical)
+}
+
+func (suite *MaskClustererTestSuite) TestProposeRegistrySkipsLiteralTemplates() {
+	sentence, _ := DrainSentence([]rune("job 7 finished"), LogMask("job <*> finished"))
+	suite.templates.Put(sentence.Fingerprint, sentence.Mask)
+	other, _ := DrainSentence([]rune("job 7 finishes"), LogMask("job <*> finishes"))
+	suite.templates.Put(other.Fingerprint, other.Mask)
+
+	suite.Empty(suite.clusterer.ProposeRegistry(suite.templates, suite.contextRegistry))
+}
+
+func (suite *MaskClustererTestSuite) TestPrintProposals() {
+	proposals := []MergeProposal{{Canonical: LogMask("Y=Y, Y=Y"), Members: []LogMask{LogMask(`Y=Y", Y=Y`)}}}
+
+	var out bytes.Buffer
+	PrintProposals(proposals, &out)
+
+	expected := fmt.Sprintf("near-duplicates of %s \"Y=Y, Y=Y\": %s\n", FingerprintOf(LogMask("Y=Y, Y=Y")), FingerprintOf(LogMask(`Y=Y", Y=Y`)))
+	suite.Equal(expected, out.String())
+}
+
+func (suite *MaskClustererTestSuite) TestMergeRemapsContext() {
+	suite.register("Y=Y, Y=Y", "a", "b", "c", "d")
+	member := suite.register(`Y=Y", Y=Y`)
+
+	proposal := MergeProposal{
+		Canonical: LogMask("Y=Y, Y=Y"),
+		Members:   []LogMask{LogMask(`Y=Y", Y=Y`)},
+	}
+	suite.NoError(suite.clusterer.Merge(proposal, suite.maskRegistry, suite.contextRegistry))
+
+	status, err := suite.maskRegistry.Get(member)
+	suite.NoError(err)
+	suite.Equal(MaskRegistered, status.State)
+
+	context, err := suite.contextRegistry.Get(member)
+	suite.NoError(err)
+	suite.Equal([]string{"a", "b", "c", "d"}, context.labels)
+}
+
+func (suite *MaskClustererTestSuite) TestMergeWithoutCanonicalContext() {
+	proposal := MergeProposal{
+		Canonical: LogMask("Y=Y"),
+		Members:   []LogMask{LogMask(`Y=Y"`)},
+	}
+
+	err := suite.clusterer.Merge(proposal, suite.maskRegistry, suite.contextRegistry)
+	suite.Error(err)
+}
+
+func TestMaskClustererTestSuite(t *testing.T) {
+	suite.Run(t, new(MaskClustererTestSuite))
+}
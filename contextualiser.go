@@ -2,151 +2,485 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
-
-	"github.com/braintrustdata/braintrust-go"
+	"sync/atomic"
+	"time"
 )
 
-type samples []Sentence
+// samples accumulates the sentences of a mask until it is contextualised
+type samples struct {
+	sentences []Sentence
+	reservoir []Sentence // Lines of the mask the samples sent to the contextualiser are selected from
+	count     int        // Sentences accumulated in memory and spilled
+	firstSeen time.Time
+	spilled   bool // Set once a sentence went to the spill queue, later ones follow it to keep their order
+	released  bool // Set once the mask is registered or failed, later sentences are routed straight away
+}
 
 type Contextualiser interface {
 	contextualise(ContextCandidate) (Context, error)
-	accumulate(Sentence, chan Sentence) error
-	Ingest(chan Sentence) error
+	accumulate(Sentence, chan Sentence, chan Sentence) error
+	Ingest(chan Sentence, chan Sentence, chan Sentence) error
 }
 
 type SentenceContextualiser struct {
 	sampleStore     *MemoryStore[samples]
 	contextRegistry *MemoryStore[Context]
-	maskRegistry    *MemoryStore[bool]
+	maskRegistry    *MemoryStore[MaskStatus]
+	templates       *MemoryStore[LogMask]
 	wg              *sync.WaitGroup
-	bClient         braintrust.Client
+	pending         sync.WaitGroup // In-flight contextualise calls that still write to the registered or fallback chan
+	provider        ContextProvider
+	fallback        ContextProvider // Optional, asked once when the provider could not label a mask
+	retry           RetryPolicy
+	sampling        SamplePolicy
+	calls           *callPool
+	limiter         *rateLimiter
+	budget          *Budget
+	clusterer       *MaskClusterer // Optional, nil disables near-duplicate detection
+	mergeClusters   bool
+	backlogLimit    int64       // Sentences held in memory across masks before spilling, 0 is unbounded
+	spill           *SpillQueue // Required when backlogLimit is set
+	inMemory        atomic.Int64
+}
+
+type ContextualiserOption func(*SentenceContextualiser)
+
+// WithBacklog holds at most limit pending sentences in memory. Sentences over the limit are spilled
+// to a segment of their mask in spill and replayed in order when the mask is released.
+func WithBacklog(limit int, spill *SpillQueue) ContextualiserOption {
+	return func(sc *SentenceContextualiser) {
+		sc.backlogLimit = int64(limit)
+		sc.spill = spill
+	}
+}
+
+// WithSamplePolicy replaces the default threshold and sample selection of masks
+func WithSamplePolicy(policy SamplePolicy) ContextualiserOption {
+	return func(sc *SentenceContextualiser) {
+		sc.sampling = policy
+	}
+}
+
+// WithRetry replaces the default retry policy of provider calls
+func WithRetry(policy RetryPolicy) ContextualiserOption {
+	return func(sc *SentenceContextualiser) {
+		sc.retry = policy
+	}
+}
+
+// WithCallWorkers contextualises at most n masks at once
+func WithCallWorkers(n int) ContextualiserOption {
+	return func(sc *SentenceContextualiser) {
+		sc.calls = newCallPool(n)
+	}
+}
+
+// WithRateLimit makes at most perSecond provider calls a second
+func WithRateLimit(perSecond float64) ContextualiserOption {
+	return func(sc *SentenceContextualiser) {
+		sc.limiter = newRateLimiter(perSecond)
+	}
+}
+
+// WithBudget stops calling the provider once the run made maxCalls calls or sent maxTokens
+// estimated prompt tokens. Masks over budget take the fallback path.
+func WithBudget(maxCalls, maxTokens int64) ContextualiserOption {
+	return func(sc *SentenceContextualiser) {
+		sc.budget = &Budget{MaxCalls: maxCalls, MaxTokens: maxTokens}
+	}
+}
+
+// WithFallbackProvider labels masks with fallback when the provider fails or the budget is spent
+func WithFallbackProvider(fallback ContextProvider) ContextualiserOption {
+	return func(sc *SentenceContextualiser) {
+		sc.fallback = fallback
+	}
 }
 
-func NewSentenceContextualiser(contextRegistry *MemoryStore[Context], maskRegistry *MemoryStore[bool], wg *sync.WaitGroup) *SentenceContextualiser {
-	client := braintrust.NewClient() // Defaults to os.LookUpEnv("BRAINTRUST_API_KEY")
-	return &SentenceContextualiser{
+func NewSentenceContextualiser(provider ContextProvider, contextRegistry *MemoryStore[Context], maskRegistry *MemoryStore[MaskStatus], templates *MemoryStore[LogMask], clusterer *MaskClusterer, mergeClusters bool, wg *sync.WaitGroup, opts ...ContextualiserOption) *SentenceContextualiser {
+	sc := &SentenceContextualiser{
 		sampleStore: &MemoryStore[samples]{
-			data: make(map[string]samples),
+			data: make(map[Fingerprint]samples),
 		},
 		contextRegistry: contextRegistry,
 		maskRegistry:    maskRegistry,
+		templates:       templates,
 		wg:              wg,
-		bClient:         client,
+		provider:        provider,
+		retry:           defaultRetryPolicy,
+		sampling:        defaultSamplePolicy,
+		calls:           newCallPool(defaultCallWorkers),
+		limiter:         newRateLimiter(0),
+		budget:          &Budget{},
+		clusterer:       clusterer,
+		mergeClusters:   mergeClusters,
 	}
+	for _, opt := range opts {
+		opt(sc)
+	}
+
+	return sc
 }
 
-type ContextualiseResponse struct {
-	Labels []string `json:"labels"`
+// Spent returns the provider calls and estimated prompt tokens of the run so far
+func (sc *SentenceContextualiser) Spent() (int64, int64) {
+	return sc.budget.Spent()
 }
 
 func (sc *SentenceContextualiser) contextualise(input ContextCandidate) (Context, error) {
-	// Responsible for preparing an api call to openai using the information in the input.
-	response, err := sc.bClient.Functions.Invoke(context.TODO(), "a26dfd04-0fd7-4a77-aa45-826560d785ab", braintrust.FunctionInvokeParams{
-		Input: map[string]interface{}{
-			"examples": "<examples><i>03-17 16:13:45.382  1702  3697 D PowerManagerService: acquire lock=189667585, flags=0x1, tag=\"*launch*\", name=android, ws=WorkSource{10113}, uid=1000, pid=1702</i></examples>",
-			"template": "<template>Y-Y Y:Y:Y.Y  Y  Y Y Y: Y Y=Y, Y=Y, Y=\"X\", Y=Y, Y=Y{X}, Y=Y, Y=Y</template>",
-		},
-	})
+	return sc.provider.Contextualise(context.TODO(), input)
+}
 
-	if err != nil {
-		return Context{}, err
-	}
+// label asks the provider for the labels of a candidate until it answers one label per position.
+// Provider errors are retried after a backoff unless they are permanent, and a wrong number of
+// labels is re-prompted with the mismatch as feedback.
+func (sc *SentenceContextualiser) label(candidate ContextCandidate) ([]string, error) {
+	attempts := max(sc.retry.Attempts, 1)
+	var err error
+	failed := false // Only failed calls back off, re-prompts are sent straight away
+	for attempt := 0; attempt < attempts; attempt++ {
+		if failed {
+			time.Sleep(sc.retry.backoff(attempt))
+		}
 
-	// The response is a pointer to any, so we need to dereference it first
-	responseMap, ok := (*response).(map[string]interface{})
-	if !ok {
-		return Context{}, fmt.Errorf("failed to assert response as map[string]interface{}")
+		if !sc.budget.spend(estimateTokens(candidate)) {
+			return nil, ErrBudgetExhausted
+		}
+
+		sc.limiter.Wait()
+		var context Context
+		context, err = sc.contextualise(candidate)
+		if errors.Is(err, ErrPermanent) {
+			return nil, err
+		}
+
+		failed = err != nil
+		if failed {
+			continue
+		}
+
+		// Only the unknown positions are up to the contextualiser
+		labels, ok := FillLabels(candidate.Known, context.labels)
+		if ok {
+			return labels, nil
+		}
+
+		err = fmt.Errorf("%d labels for %d positions", len(context.labels), len(candidate.Known))
+		candidate.Feedback = fmt.Sprintf("The previous answer had %d labels, answer exactly %d labels, one per placeholder of the template.", len(context.labels), candidate.ExpectedLabels())
 	}
 
-	// Extract the labels field from the response
-	labelsInterface, exists := responseMap["labels"]
-	if !exists {
-		return Context{}, fmt.Errorf("labels field not found in response")
+	return nil, fmt.Errorf("%d attempts: %w", attempts, err)
+}
+
+// labelFallback asks the fallback provider about a candidate the provider failed to label
+func (sc *SentenceContextualiser) labelFallback(candidate ContextCandidate, failure error) ([]string, error) {
+	context, err := sc.fallback.Contextualise(context.TODO(), candidate)
+	if err != nil {
+		return nil, fmt.Errorf("%w, fallback: %w", failure, err)
 	}
 
-	// Type assert the labels to []interface{} and convert to []string
-	labelsSlice, ok := labelsInterface.([]interface{})
+	labels, ok := FillLabels(candidate.Known, context.labels)
 	if !ok {
-		return Context{}, fmt.Errorf("labels field is not an array")
+		return nil, fmt.Errorf("%w, fallback: %d labels for %d positions", failure, len(context.labels), len(candidate.Known))
 	}
 
-	var labels []string
-	for _, label := range labelsSlice {
-		labelStr, ok := label.(string)
-		if !ok {
-			return Context{}, fmt.Errorf("label is not a string: %v", label)
+	return labels, nil
+}
+
+func (sc *SentenceContextualiser) accumulate(input Sentence, registeredChan chan Sentence, fallbackChan chan Sentence) error {
+	m := input.Fingerprint
+
+	// Only accumulate creates entries, so a mask without one is new
+	if _, err := sc.sampleStore.Get(m); err != nil {
+		if sc.extractPairs(input, registeredChan) {
+			return nil
+		}
+
+		if sc.nearDuplicate(input, registeredChan) {
+			return nil
 		}
-		labels = append(labels, labelStr)
 	}
 
-	return Context{labels: labels}, nil
-}
+	// We want to keep accumulate all samples that have the same mask. Appending and releasing are
+	// atomic, so a sentence is either released with the samples or forwarded here.
+	entry, added := sc.sampleStore.Update(m, func(entry samples, _ bool) (samples, bool) {
+		if entry.released {
+			return entry, false
+		}
+
+		if entry.count == 0 {
+			entry.firstSeen = time.Now()
+		}
+
+		entry.count++
+
+		// Samples count against the backlog as well. Once it is full a reservoir only replaces
+		// its lines, masks without any read theirs back from the spill queue when they start.
+		room := sc.backlogLimit == 0 || sc.inMemory.Load() < sc.backlogLimit
+		if kept := len(entry.reservoir); room || kept >= max(sc.sampling.Reservoir, 1) {
+			entry.reservoir = sc.sampling.keep(entry.reservoir, entry.count, input)
+			sc.inMemory.Add(int64(len(entry.reservoir) - kept))
+		}
+
+		if sc.backlogLimit > 0 && (entry.spilled || sc.inMemory.Load() >= sc.backlogLimit) {
+			err := sc.spill.Append(m, input)
+			if err == nil {
+				entry.spilled = true
+				return entry, true
+			}
+
+			// Holding the sentence over the limit beats losing it
+			fmt.Println("could not spill sentence:", err)
+		}
+
+		sc.inMemory.Add(1)
+		entry.sentences = append(entry.sentences, input)
+		return entry, true
+	})
+
+	if !added {
+		if isRegistered(sc.maskRegistry, m) {
+			registeredChan <- input
+		} else {
+			fallbackChan <- input
+		}
 
-func (sc *SentenceContextualiser) accumulate(input Sentence, registeredChan chan Sentence) error {
-	m := string(input.Mask)
-	samples, err := sc.sampleStore.Get(m)
-	if err != nil {
-		value := []Sentence{input}
-		sc.sampleStore.Put(m, value)
 		return nil
 	}
 
-	// We want to keep accumulate all samples that have the same mask
-	samples = append(samples, input)
-	sc.sampleStore.Put(m, samples)
+	// Only the line that completes the samples of a collecting mask starts contextualisation,
+	// priority masks do not wait for more samples
+	if entry.count >= sc.sampling.Threshold || input.Priority {
+		sc.start(m, entry, input.Priority, registeredChan, fallbackChan)
+	}
 
-	if len(samples) == 3 {
-		go func() {
-			// Syncs with admin to close registered channel
-			defer sc.wg.Done()
+	return nil
+}
 
-			var logLines []LogLine
-			for _, s := range samples {
-				logLines = append(logLines, s.Line)
-			}
+// start queues the contextualisation of a collecting mask with samples selected from its reservoir
+func (sc *SentenceContextualiser) start(m Fingerprint, entry samples, priority bool, registeredChan chan Sentence, fallbackChan chan Sentence) {
+	if !transition(sc.maskRegistry, m, MaskInFlight, "", MaskCollecting) {
+		return
+	}
 
-			candidate := ContextCandidate{
-				Mask:    input.Mask,
-				Samples: logLines,
-			}
+	// Calls are queued for the pool, priority masks ahead of the others
+	sc.pending.Add(1)
+	sc.calls.submit(func() {
+		defer sc.pending.Done()
 
-			context, err := sc.contextualise(candidate)
+		reservoir := entry.reservoir
+		if len(reservoir) == 0 && sc.spill != nil {
+			var err error
+			reservoir, err = sc.spill.Peek(m, max(sc.sampling.Reservoir, 1))
 			if err != nil {
-				fmt.Println("could not contextualise sentence")
-				return
+				fmt.Println("could not read spilled samples:", err)
 			}
+		}
 
-			// Update context registry so that context can be fetched when labelling
-			sc.contextRegistry.Put(m, context)
+		if len(reservoir) == 0 {
+			sc.fail(m, "no samples to contextualise", fallbackChan)
+			return
+		}
 
-			// Update mask registry so that admin can direct all sentences with this mask signature to the correct context
-			sc.maskRegistry.Put(m, true)
+		// Every line of the reservoir shares the mask, any of them has its pairs
+		representative := reservoir[0]
+		candidate := ContextCandidate{
+			Mask:    representative.Mask,
+			Samples: sc.sampling.selectDiverse(reservoir),
+			Known:   FoldLabels(PairLabels(representative), representative.Repetitions),
+		}
 
-			// Release all samples into registered channel for processing
-			// Refetch all samples as more could have been added
-			samples, err := sc.sampleStore.Get(m)
-			if err != nil {
-				fmt.Println("could not contextualise sentence")
-				return
+		labels, err := sc.label(candidate)
+		if err != nil && sc.fallback != nil {
+			fmt.Printf("labelling mask %s with the fallback provider: %v\n", m, err)
+			labels, err = sc.labelFallback(candidate, err)
+		}
 
-			}
+		if err != nil {
+			fmt.Printf("could not contextualise mask %s: %v\n", m, err)
+			sc.fail(m, err.Error(), fallbackChan)
+			return
+		}
+		context := Context{labels: labels, mask: candidate.Mask}
+
+		// Update context registry so that context can be fetched when labelling
+		sc.contextRegistry.Put(m, context)
+
+		// Update mask registry so that admin can direct all sentences with this mask signature to the correct context
+		registerMask(sc.maskRegistry, m)
+
+		// Release all samples into registered channel for processing
+		sc.release(m, registeredChan)
+	}, priority)
+}
+
+// expire starts the contextualisation of masks first seen at least MaxWait before now, however few
+// lines they have
+func (sc *SentenceContextualiser) expire(now time.Time, registeredChan chan Sentence, fallbackChan chan Sentence) {
+	for _, m := range sc.sampleStore.Keys() {
+		entry, err := sc.sampleStore.Get(m)
+		if err != nil || entry.released || entry.count == 0 || now.Sub(entry.firstSeen) < sc.sampling.MaxWait {
+			continue
+		}
+
+		sc.start(m, entry, false, registeredChan, fallbackChan)
+	}
+}
+
+// flush settles every mask still collecting lines once the input has ended. Masks are
+// contextualised however few lines they have when the policy flushes or waits, otherwise their
+// lines take the fallback path, so one-off lines do not cost a provider call each.
+func (sc *SentenceContextualiser) flush(registeredChan chan Sentence, fallbackChan chan Sentence) {
+	contextualise := sc.sampling.Flush || sc.sampling.MaxWait > 0
+	for _, m := range sc.sampleStore.Keys() {
+		entry, err := sc.sampleStore.Get(m)
+		if err != nil || entry.released || entry.count == 0 {
+			continue
+		}
+
+		if contextualise {
+			sc.start(m, entry, false, registeredChan, fallbackChan)
+			continue
+		}
+
+		// Masks already in flight are settled by their call
+		if transition(sc.maskRegistry, m, MaskFailed, "fewer lines than the sample threshold", MaskCollecting) {
+			sc.release(m, fallbackChan)
+		}
+	}
+}
 
-			for _, sample := range samples {
-				registeredChan <- sample
+// fail records why a mask could not be contextualised and sends its samples down the fallback path
+func (sc *SentenceContextualiser) fail(m Fingerprint, reason string, fallbackChan chan Sentence) {
+	transition(sc.maskRegistry, m, MaskFailed, reason)
+	sc.release(m, fallbackChan)
+}
+
+// release sends every accumulated sample of a mask to out. Samples are taken from the store
+// as more could have been added, and later sentences of the mask are routed by accumulate.
+// Spilled samples come after the ones in memory, so each round sends the memory batch before
+// replaying the segment. Sentences accumulated during a replay are picked up by the next round.
+func (sc *SentenceContextualiser) release(m Fingerprint, out chan Sentence) {
+	for {
+		var released []Sentence
+		var segment string
+		var dropped int
+		sc.sampleStore.Update(m, func(entry samples, _ bool) (samples, bool) {
+			released = entry.sentences
+			if entry.spilled {
+				taken, err := sc.spill.Take(m)
+				if err != nil {
+					fmt.Println("could not take spilled sentences:", err)
+				} else if taken != "" {
+					segment = taken
+					return samples{reservoir: entry.reservoir, count: entry.count, firstSeen: entry.firstSeen}, true
+				}
 			}
 
-		}()
+			dropped = len(entry.reservoir)
+			return samples{released: true}, true
+		})
+
+		sc.inMemory.Add(-int64(len(released) + dropped))
+		for _, sample := range released {
+			out <- sample
+		}
+
+		if segment == "" {
+			return
+		}
+
+		err := sc.spill.Replay(segment, func(sample Sentence) {
+			out <- sample
+		})
+		if err != nil {
+			fmt.Println("could not replay spilled sentences:", err)
+		}
+	}
+}
+
+// extractPairs registers a new mask straight away when all of its positions are key=value pairs,
+// skipping sample accumulation and the contextualiser
+func (sc *SentenceContextualiser) extractPairs(input Sentence, registeredChan chan Sentence) bool {
+	labels := FoldLabels(PairLabels(input), input.Repetitions)
+	if len(labels) == 0 || knownLabels(labels) != len(labels) {
+		return false
 	}
 
-	return nil
+	sc.contextRegistry.Put(input.Fingerprint, Context{labels: labels, mask: input.Mask})
+	registerMask(sc.maskRegistry, input.Fingerprint)
+	registeredChan <- input
+	return true
 }
 
-func (sc *SentenceContextualiser) Ingest(unRegistered chan Sentence, registered chan Sentence) error {
-	for s := range unRegistered {
-		sc.accumulate(s, registered)
+// nearDuplicate checks a newly seen mask against the contextualised masks. When merging is enabled
+// the mask inherits the context of its nearest neighbour and skips sample accumulation entirely.
+func (sc *SentenceContextualiser) nearDuplicate(input Sentence, registeredChan chan Sentence) bool {
+	// Templates with their own IDs are not symbol masks, their edit distance means nothing
+	if sc.clusterer == nil || input.TemplateID != "" {
+		return false
 	}
 
+	var candidates []LogMask
+	for _, k := range sc.contextRegistry.Keys() {
+		if mask, err := sc.templates.Get(k); err == nil {
+			candidates = append(candidates, mask)
+		}
+	}
+
+	canonical, found := sc.clusterer.Nearest(input.Mask, candidates)
+	if !found {
+		return false
+	}
+
+	if !sc.mergeClusters {
+		fmt.Printf("near-duplicate mask %s could merge into %s\n", input.Fingerprint, FingerprintOf(canonical))
+		return false
+	}
+
+	proposal := MergeProposal{Canonical: canonical, Members: []LogMask{input.Mask}}
+	if err := sc.clusterer.Merge(proposal, sc.maskRegistry, sc.contextRegistry); err != nil {
+		fmt.Println("could not merge near-duplicate mask")
+		return false
+	}
+
+	registeredChan <- input
+	return true
+}
+
+func (sc *SentenceContextualiser) Ingest(unRegistered chan Sentence, registered chan Sentence, fallback chan Sentence) error {
+	go func() {
+		// Syncs with admin to close registered and fallback channels once no contextualise call can release samples
+		defer sc.wg.Done()
+
+		// Masks waiting on more lines are checked on the same goroutine as accumulate
+		var expiry <-chan time.Time
+		if sc.sampling.MaxWait > 0 {
+			ticker := time.NewTicker(max(sc.sampling.MaxWait/2, time.Millisecond))
+			defer ticker.Stop()
+			expiry = ticker.C
+		}
+
+		for {
+			select {
+			case s, ok := <-unRegistered:
+				if !ok {
+					// No more lines can arrive, so masks below the threshold are not waited on any longer
+					sc.flush(registered, fallback)
+
+					sc.pending.Wait()
+					return
+				}
+
+				sc.accumulate(s, registered, fallback)
+			case now := <-expiry:
+				sc.expire(now, registered, fallback)
+			}
+		}
+	}()
+
 	return nil
 }
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// SentenceContextualiserTestSuite provides test suite for SentenceContextualiser
+type SentenceContextualiserTestSuite struct {
+	suite.Suite
+	contextualiser  *SentenceContextualiser
+	provider        *FakeContextProvider
+	contextRegistry *MemoryStore[Context]
+	maskRegistry    *MemoryStore[MaskStatus]
+	helper          *TestHelper
+}
+
+func (suite *SentenceContextualiserTestSuite) SetupTest() {
+	suite.contextRegistry = NewContextStore()
+	suite.maskRegistry = NewMaskStatusStore()
+	suite.provider = NewFakeContextProvider()
+	retry := RetryPolicy{Attempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	suite.contextualiser = NewSentenceContextualiser(suite.provider, suite.contextRegistry, suite.maskRegistry, NewTemplateStore(), nil, false, nil, WithRetry(retry))
+	suite.helper = &TestHelper{}
+}
+
+func (suite *SentenceContextualiserTestSuite) TestAccumulatesUnknownMasks() {
+	sentence := suite.helper.CreateTestSentence("I started", []string{"I", "started"}, "Y Y")
+
+	registered := make(chan Sentence, 1)
+	suite.NoError(suite.contextualiser.accumulate(sentence, registered, nil))
+	suite.NoError(suite.contextualiser.accumulate(sentence, registered, nil))
+
+	entry, err := suite.contextualiser.sampleStore.Get(sentence.Fingerprint)
+	suite.NoError(err)
+	suite.Len(entry.sentences, 2)
+	suite.Empty(registered)
+}
+
+func (suite *SentenceContextualiserTestSuite) TestForwardsSentencesOfReleasedMasks() {
+	// A sentence routed as unregistered just before its mask was registered must not be stranded
+	sentence := suite.helper.CreateTestSentence("I started", []string{"I", "started"}, "Y Y")
+	suite.contextualiser.sampleStore.Put(sentence.Fingerprint, samples{released: true})
+	suite.maskRegistry.Put(sentence.Fingerprint, MaskStatus{State: MaskRegistered})
+
+	registered := make(chan Sentence, 1)
+	suite.NoError(suite.contextualiser.accumulate(sentence, registered, nil))
+
+	suite.Equal(sentence.Line, (<-registered).Line)
+	entry, err := suite.contextualiser.sampleStore.Get(sentence.Fingerprint)
+	suite.NoError(err)
+	suite.Empty(entry.sentences)
+}
+
+func (suite *SentenceContextualiserTestSuite) TestFailedMasksTakeFallback() {
+	sentence := suite.helper.CreateTestSentence("I started", []string{"I", "started"}, "Y Y")
+	suite.maskRegistry.Put(sentence.Fingerprint, MaskStatus{State: MaskInFlight, Count: 2})
+
+	fallback := make(chan Sentence, 2)
+	suite.NoError(suite.contextualiser.accumulate(sentence, nil, fallback))
+	suite.contextualiser.fail(sentence.Fingerprint, "no labels", fallback)
+
+	// Accumulated samples are released down the fallback path
+	suite.Equal(sentence.Line, (<-fallback).Line)
+
+	status, err := suite.maskRegistry.Get(sentence.Fingerprint)
+	suite.NoError(err)
+	suite.Equal(MaskFailed, status.State)
+	suite.Equal("no labels", status.Failure)
+	suite.Equal(2, status.Count)
+
+	// Later sentences that were already routed as unregistered follow them
+	suite.NoError(suite.contextualiser.accumulate(sentence, nil, fallback))
+	suite.Equal(sentence.Line, (<-fallback).Line)
+}
+
+func (suite *SentenceContextualiserTestSuite) TestRegistersAfterThreeSamples() {
+	suite.provider.SetLabels("Y Y", []string{"subject", "event"})
+	sentence := suite.helper.CreateTestSentence("I started", []string{"I", "started"}, "Y Y")
+	suite.maskRegistry.Put(sentence.Fingerprint, MaskStatus{State: MaskCollecting})
+
+	registered := make(chan Sentence, 3)
+	for i := 0; i < 3; i++ {
+		suite.NoError(suite.contextualiser.accumulate(sentence, registered, nil))
+	}
+	suite.contextualiser.pending.Wait()
+
+	suite.Len(registered, 3)
+	suite.True(isRegistered(suite.maskRegistry, sentence.Fingerprint))
+	context, err := suite.contextRegistry.Get(sentence.Fingerprint)
+	suite.NoError(err)
+	suite.Equal([]string{"subject", "event"}, context.labels)
+
+	candidates := suite.provider.Candidates()
+	suite.Len(candidates, 1)
+	suite.Equal(LogMask("Y Y"), candidates[0].Mask)
+	suite.Len(candidates[0].Samples, 3)
+}
+
+func (suite *SentenceContextualiserTestSuite) TestPriorityMasksSkipThreshold() {
+	suite.provider.SetLabels("Y Y", []string{"subject", "event"})
+	sentence := suite.helper.CreateTestSentence("I started", []string{"I", "started"}, "Y Y")
+	sentence.Priority = true
+	suite.maskRegistry.Put(sentence.Fingerprint, MaskStatus{State: MaskCollecting})
+
+	registered := make(chan Sentence, 1)
+	suite.NoError(suite.contextualiser.accumulate(sentence, registered, nil))
+	suite.contextualiser.pending.Wait()
+
+	suite.Equal(sentence.Line, (<-registered).Line)
+	suite.True(isRegistered(suite.maskRegistry, sentence.Fingerprint))
+}
+
+func (suite *SentenceContextualiserTestSuite) TestProviderErrorsFailMask() {
+	suite.provider.SetError(errors.New("unavailable"))
+	sentence := suite.helper.CreateTestSentence("I started", []string{"I", "started"}, "Y Y")
+	sentence.Priority = true
+	suite.maskRegistry.Put(sentence.Fingerprint, MaskStatus{State: MaskCollecting})
+
+	fallback := make(chan Sentence, 1)
+	suite.NoError(suite.contextualiser.accumulate(sentence, nil, fallback))
+	suite.contextualiser.pending.Wait()
+
+	suite.Equal(sentence.Line, (<-fallback).Line)
+	status, err := suite.maskRegistry.Get(sentence.Fingerprint)
+	suite.NoError(err)
+	suite.Equal(MaskFailed, status.State)
+	suite.Equal("3 attempts: unavailable", status.Failure)
+	suite.Len(suite.provider.Candidates(), 3)
+}
+
+func (suite *SentenceContextualiserTestSuite) TestRetriesTransientErrors() {
+	suite.provider.Respond(nil, errors.New("timeout"))
+	suite.provider.SetLabels("Y Y", []string{"subject", "event"})
+
+	labels, err := suite.contextualiser.label(ContextCandidate{Mask: LogMask("Y Y"), Known: []string{"", ""}})
+	suite.NoError(err)
+	suite.Equal([]string{"subject", "event"}, labels)
+	suite.Len(suite.provider.Candidates(), 2)
+}
+
+func (suite *SentenceContextualiserTestSuite) TestRepromptsLabelCountMismatch() {
+	suite.provider.Respond([]string{"subject"}, nil)
+	suite.provider.SetLabels("Y Y", []string{"subject", "event"})
+
+	labels, err := suite.contextualiser.label(ContextCandidate{Mask: LogMask("Y Y"), Known: []string{"", ""}})
+	suite.NoError(err)
+	suite.Equal([]string{"subject", "event"}, labels)
+
+	candidates := suite.provider.Candidates()
+	suite.Len(candidates, 2)
+	suite.Empty(candidates[0].Feedback)
+	suite.Contains(candidates[1].Feedback, "exactly 2 labels")
+}
+
+func (suite *SentenceContextualiserTestSuite) TestGivesUpOnPermanentErrors() {
+	suite.provider.Respond(nil, fmt.Errorf("%w: unauthorised", ErrPermanent))
+	suite.provider.SetLabels("Y Y", []string{"subject", "event"})
+
+	_, err := suite.contextualiser.label(ContextCandidate{Mask: LogMask("Y Y"), Known: []string{"", ""}})
+	suite.ErrorIs(err, ErrPermanent)
+	suite.Len(suite.provider.Candidates(), 1)
+}
+
+func (suite *SentenceContextualiserTestSuite) TestFailsAfterRepeatedMismatches() {
+	suite.provider.SetLabels("Y Y", []string{"subject"})
+
+	_, err := suite.contextualiser.label(ContextCandidate{Mask: LogMask("Y Y"), Known: []string{"", ""}})
+	suite.EqualError(err, "3 attempts: 1 labels for 2 positions")
+}
+
+func (suite *SentenceContextualiserTestSuite) TestMasksOverBudgetTakeFallback() {
+	suite.provider.SetLabels("Y Y", []string{"subject", "event"})
+	contextualiser := NewSentenceContextualiser(suite.provider, suite.contextRegistry, suite.maskRegistry, NewTemplateStore(), nil, false, nil, WithBudget(1, 0))
+
+	first := suite.helper.CreateTestSentence("I started", []string{"I", "started"}, "Y Y")
+	second := suite.helper.CreateTestSentence("started at", []string{"started", "at"}, "Y Y.")
+	first.Priority, second.Priority = true, true
+	suite.maskRegistry.Put(first.Fingerprint, MaskStatus{State: MaskCollecting})
+	suite.maskRegistry.Put(second.Fingerprint, MaskStatus{State: MaskCollecting})
+
+	registered := make(chan Sentence, 1)
+	fallback := make(chan Sentence, 1)
+	suite.NoError(contextualiser.accumulate(first, registered, fallback))
+	contextualiser.pending.Wait()
+	suite.NoError(contextualiser.accumulate(second, registered, fallback))
+	contextualiser.pending.Wait()
+
+	suite.Equal(first.Line, (<-registered).Line)
+	suite.Equal(second.Line, (<-fallback).Line)
+
+	status, err := suite.maskRegistry.Get(second.Fingerprint)
+	suite.NoError(err)
+	suite.Equal(MaskFailed, status.State)
+	suite.Equal(ErrBudgetExhausted.Error(), status.Failure)
+}
+
+func (suite *SentenceContextualiserTestSuite) TestConfigurableThreshold() {
+	suite.provider.SetLabels("Y Y", []string{"subject", "event"})
+	contextualiser := NewSentenceContextualiser(suite.provider, suite.contextRegistry, suite.maskRegistry, NewTemplateStore(), nil, false, nil,
+		WithSamplePolicy(SamplePolicy{Threshold: 5, Reservoir: 8, Samples: 2}))
+
+	sentence := suite.helper.CreateTestSentence("I started", []string{"I", "started"}, "Y Y")
+	suite.maskRegistry.Put(sentence.Fingerprint, MaskStatus{State: MaskCollecting})
+
+	registered := make(chan Sentence, 5)
+	for i := 0; i < 4; i++ {
+		suite.NoError(contextualiser.accumulate(sentence, registered, nil))
+	}
+	contextualiser.pending.Wait()
+	suite.Empty(suite.provider.Candidates())
+
+	suite.NoError(contextualiser.accumulate(sentence, registered, nil))
+	contextualiser.pending.Wait()
+
+	candidates := suite.provider.Candidates()
+	suite.Len(candidates, 1)
+	suite.Len(candidates[0].Samples, 2)
+	suite.Len(registered, 5)
+}
+
+func (suite *SentenceContextualiserTestSuite) TestExpiresWaitingMasks() {
+	suite.provider.SetLabels("Y Y", []string{"subject", "event"})
+	contextualiser := NewSentenceContextualiser(suite.provider, suite.contextRegistry, suite.maskRegistry, NewTemplateStore(), nil, false, nil,
+		WithSamplePolicy(SamplePolicy{Threshold: 3, MaxWait: time.Minute, Reservoir: 8, Samples: 3}))
+
+	sentence := suite.helper.CreateTestSentence("I started", []string{"I", "started"}, "Y Y")
+	suite.maskRegistry.Put(sentence.Fingerprint, MaskStatus{State: MaskCollecting})
+
+	registered := make(chan Sentence, 1)
+	suite.NoError(contextualiser.accumulate(sentence, registered, nil))
+
+	// Not yet waited long enough
+	contextualiser.expire(time.Now(), registered, nil)
+	contextualiser.pending.Wait()
+	suite.Empty(suite.provider.Candidates())
+
+	contextualiser.expire(time.Now().Add(time.Minute), registered, nil)
+	contextualiser.pending.Wait()
+	suite.Len(suite.provider.Candidates(), 1)
+	suite.Equal(sentence.Line, (<-registered).Line)
+	suite.True(isRegistered(suite.maskRegistry, sentence.Fingerprint))
+}
+
+func (suite *SentenceContextualiserTestSuite) TestIngestExpiresWaitingMasks() {
+	suite.provider.SetLabels("Y Y", []string{"subject", "event"})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	contextualiser := NewSentenceContextualiser(suite.provider, suite.contextRegistry, suite.maskRegistry, NewTemplateStore(), nil, false, &wg,
+		WithSamplePolicy(SamplePolicy{Threshold: 3, MaxWait: 10 * time.Millisecond, Reservoir: 8, Samples: 3}))
+
+	sentence := suite.helper.CreateTestSentence("I started", []string{"I", "started"}, "Y Y")
+	suite.maskRegistry.Put(sentence.Fingerprint, MaskStatus{State: MaskCollecting})
+
+	unRegistered := make(chan Sentence, 1)
+	registered := make(chan Sentence, 1)
+	suite.NoError(contextualiser.Ingest(unRegistered, registered, nil))
+	unRegistered <- sentence
+
+	// The only line of the mask is released without closing the input
+	suite.Equal(sentence.Line, (<-registered).Line)
+	close(unRegistered)
+	wg.Wait()
+}
+
+func (suite *SentenceContextualiserTestSuite) TestIngestExpiresWaitingMasksAtEndOfInput() {
+	suite.provider.SetLabels("Y Y", []string{"subject", "event"})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	contextualiser := NewSentenceContextualiser(suite.provider, suite.contextRegistry, suite.maskRegistry, NewTemplateStore(), nil, false, &wg,
+		WithSamplePolicy(SamplePolicy{Threshold: 3, MaxWait: time.Hour, Reservoir: 8, Samples: 3}))
+
+	sentence := suite.helper.CreateTestSentence("I started", []string{"I", "started"}, "Y Y")
+	suite.maskRegistry.Put(sentence.Fingerprint, MaskStatus{State: MaskCollecting})
+
+	unRegistered := make(chan Sentence, 1)
+	registered := make(chan Sentence, 1)
+	suite.NoError(contextualiser.Ingest(unRegistered, registered, nil))
+	unRegistered <- sentence
+	close(unRegistered)
+	wg.Wait()
+
+	suite.Equal(sentence.Line, (<-registered).Line)
+}
+
+// ingestOneOffs runs lines of distinct masks through Ingest and returns the lines that were
+// registered and those that took the fallback path
+func (suite *SentenceContextualiserTestSuite) ingestOneOffs(policy SamplePolicy, count int) ([]Sentence, []Sentence) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	contextualiser := NewSentenceContextualiser(suite.provider, suite.contextRegistry, suite.maskRegistry, NewTemplateStore(), nil, false, &wg, WithSamplePolicy(policy))
+
+	unRegistered := make(chan Sentence, count)
+	registered := make(chan Sentence, count)
+	fallback := make(chan Sentence, count)
+	suite.NoError(contextualiser.Ingest(unRegistered, registered, fallback))
+	for i := 0; i < count; i++ {
+		words := make([]string, i+1)
+		for w := range words {
+			words[w] = "w"
+		}
+
+		sentence := suite.helper.CreateTestSentence(strings.Join(words, " "), words, strings.TrimSpace(strings.Repeat("Y ", i+1)))
+		suite.maskRegistry.Put(sentence.Fingerprint, MaskStatus{State: MaskCollecting})
+		suite.provider.SetLabels(string(sentence.Mask), words)
+		unRegistered <- sentence
+	}
+	close(unRegistered)
+	wg.Wait()
+	close(registered)
+	close(fallback)
+
+	var labelled, unlabelled []Sentence
+	for s := range registered {
+		labelled = append(labelled, s)
+	}
+	for s := range fallback {
+		unlabelled = append(unlabelled, s)
+	}
+
+	return labelled, unlabelled
+}
+
+func (suite *SentenceContextualiserTestSuite) TestIngestSendsOneOffMasksToFallbackAtEndOfInput() {
+	// Masks below the threshold cost no provider call unless the policy flushes them
+	labelled, unlabelled := suite.ingestOneOffs(defaultSamplePolicy, 5)
+
+	suite.Empty(suite.provider.Candidates())
+	suite.Empty(labelled)
+	suite.Len(unlabelled, 5)
+
+	status, err := suite.maskRegistry.Get(unlabelled[0].Fingerprint)
+	suite.NoError(err)
+	suite.Equal(MaskFailed, status.State)
+}
+
+func (suite *SentenceContextualiserTestSuite) TestIngestFlushesOneOffMasksWhenAsked() {
+	policy := defaultSamplePolicy
+	policy.Flush = true
+	labelled, unlabelled := suite.ingestOneOffs(policy, 5)
+
+	suite.Len(suite.provider.Candidates(), 5)
+	suite.Len(labelled, 5)
+	suite.Empty(unlabelled)
+}
+
+func (suite *SentenceContextualiserTestSuite) TestSpillsOverBacklogLimit() {
+	spill, err := NewSpillQueue(suite.T().TempDir())
+	suite.Require().NoError(err)
+	contextualiser := NewSentenceContextualiser(NewFakeContextProvider(), suite.contextRegistry, suite.maskRegistry, NewTemplateStore(), nil, false, nil, WithBacklog(2, spill))
+
+	lines := []string{"I started", "I stopped", "I paused"}
+	for _, line := range lines {
+		words := []string{"I", line[2:]}
+		suite.NoError(contextualiser.accumulate(suite.helper.CreateTestSentence(line, words, "Y Y"), nil, nil))
+	}
+
+	m := FingerprintOf(LogMask("Y Y"))
+	entry, err := contextualiser.sampleStore.Get(m)
+	suite.NoError(err)
+	suite.Len(entry.sentences, 1)
+	suite.True(entry.spilled)
+	suite.Equal(3, entry.count)
+
+	// The sample counts against the backlog, so no more are kept once it is full
+	suite.Len(entry.reservoir, 1)
+	suite.Equal(int64(2), contextualiser.inMemory.Load())
+
+	// Released samples come back in the order they were accumulated
+	registered := make(chan Sentence, 3)
+	contextualiser.release(m, registered)
+	close(registered)
+
+	var released []string
+	for s := range registered {
+		released = append(released, string(s.Line))
+	}
+	suite.Equal(lines, released)
+	suite.Zero(contextualiser.inMemory.Load())
+}
+
+func (suite *SentenceContextualiserTestSuite) TestSamplesMasksFromSpillWhenBacklogIsFull() {
+	suite.provider.SetLabels("Y Y Y Y", []string{"subject", "event", "preposition", "hour"})
+	spill, err := NewSpillQueue(suite.T().TempDir())
+	suite.Require().NoError(err)
+	contextualiser := NewSentenceContextualiser(suite.provider, suite.contextRegistry, suite.maskRegistry, NewTemplateStore(), nil, false, nil, WithBacklog(1, spill))
+
+	// The first mask fills the backlog with its sample, the second one keeps none in memory
+	first := suite.helper.CreateTestSentence("I started", []string{"I", "started"}, "Y Y")
+	second := suite.helper.CreateTestSentence("I started at 5", []string{"I", "started", "at", "5"}, "Y Y Y Y")
+	suite.NoError(contextualiser.accumulate(first, nil, nil))
+	for i := 0; i < 3; i++ {
+		suite.NoError(contextualiser.accumulate(second, nil, nil))
+	}
+
+	entry, err := contextualiser.sampleStore.Get(second.Fingerprint)
+	suite.NoError(err)
+	suite.Empty(entry.reservoir)
+	suite.Empty(entry.sentences)
+	suite.Equal(int64(1), contextualiser.inMemory.Load())
+
+	suite.maskRegistry.Put(second.Fingerprint, MaskStatus{State: MaskCollecting})
+	registered := make(chan Sentence, 3)
+	contextualiser.start(second.Fingerprint, entry, false, registered, nil)
+	contextualiser.pending.Wait()
+
+	suite.True(isRegistered(suite.maskRegistry, second.Fingerprint))
+	suite.Len(registered, 3)
+	candidates := suite.provider.Candidates()
+	suite.Len(candidates, 1)
+	suite.Equal(LogMask("Y Y Y Y"), candidates[0].Mask)
+}
+
+func TestSentenceContextualiserTestSuite(t *testing.T) {
+	suite.Run(t, new(SentenceContextualiserTestSuite))
+}
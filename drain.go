@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Drain groups lines with a fixed depth parse tree instead of exact symbol masks.
+// Lines are split on whitespace, routed by token count and their leading tokens,
+// and merged into the most similar template in the leaf when the similarity is
+// above the threshold. Differing positions become wildcards and are emitted as tokens.
+const (
+	drainWildcard = "<*>"
+
+	defaultDrainDepth       = 4
+	defaultDrainSimilarity  = 0.4
+	defaultDrainMaxChildren = 100
+)
+
+type drainNode struct {
+	children map[string]*drainNode
+	clusters []*drainCluster
+}
+
+type drainCluster struct {
+	template []string
+	size     int
+}
+
+type DrainConsumer struct {
+	depth       int
+	similarity  float64
+	maxChildren int
+	root        *drainNode
+	clusters    []*drainCluster
+}
+
+func NewDrainConsumer(depth int, similarity float64, maxChildren int) *DrainConsumer {
+	// Root and length layers always exist, so anything shallower cannot route on tokens
+	if depth < 3 {
+		depth = 3
+	}
+
+	return &DrainConsumer{
+		depth:       depth,
+		similarity:  similarity,
+		maxChildren: maxChildren,
+		root:        newDrainNode(),
+	}
+}
+
+func newDrainNode() *drainNode {
+	return &drainNode{
+		children: make(map[string]*drainNode),
+	}
+}
+
+// splitFields splits a line on whitespace, returning the fields and their spans in the line
+func splitFields(input []rune) ([]string, []Span) {
+	var fields []string
+	var spans []Span
+	start := -1
+	for i, r := range input {
+		if !unicode.IsSpace(r) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+
+		if start >= 0 {
+			fields = append(fields, string(input[start:i]))
+			spans = append(spans, Span{Start: start, End: i})
+			start = -1
+		}
+	}
+
+	if start >= 0 {
+		fields = append(fields, string(input[start:]))
+		spans = append(spans, Span{Start: start, End: len(input)})
+	}
+
+	return fields, spans
+}
+
+func hasDigit(token string) bool {
+	for _, r := range token {
+		if r >= '0' && r <= '9' {
+			return true
+		}
+	}
+
+	return false
+}
+
+// leaf walks (and grows) the tree down to the leaf responsible for the given tokens
+func (dc *DrainConsumer) leaf(tokens []string) *drainNode {
+	lengthKey := strconv.Itoa(len(tokens))
+	node, exists := dc.root.children[lengthKey]
+	if !exists {
+		node = newDrainNode()
+		dc.root.children[lengthKey] = node
+	}
+
+	for i := 0; i < dc.depth-2 && i < len(tokens); i++ {
+		key := tokens[i]
+		// Tokens with digits are most likely variables, routing on them would explode the tree
+		if hasDigit(key) {
+			key = drainWildcard
+		}
+
+		child, exists := node.children[key]
+		// Full nodes send every new key down a shared wildcard branch
+		if !exists && len(node.children) >= dc.maxChildren {
+			key = drainWildcard
+			child, exists = node.children[key]
+		}
+
+		if !exists {
+			child = newDrainNode()
+			node.children[key] = child
+		}
+
+		node = child
+	}
+
+	return node
+}
+
+func similarity(template []string, tokens []string) (float64, int) {
+	var same, wildcards int
+	for i, t := range template {
+		if t == drainWildcard {
+			wildcards++
+			continue
+		}
+
+		if t == tokens[i] {
+			same++
+		}
+	}
+
+	if len(template) == 0 {
+		return 1, wildcards
+	}
+
+	return float64(same) / float64(len(template)), wildcards
+}
+
+func (dc *DrainConsumer) match(node *drainNode, tokens []string) *drainCluster {
+	var best *drainCluster
+	bestSim, bestWildcards := -1.0, -1
+	for _, c := range node.clusters {
+		sim, wildcards := similarity(c.template, tokens)
+		if sim > bestSim || (sim == bestSim && wildcards > bestWildcards) {
+			best, bestSim, bestWildcards = c, sim, wildcards
+		}
+	}
+
+	if best == nil || bestSim < dc.similarity {
+		return nil
+	}
+
+	return best
+}
+
+// add routes a line into its cluster, updating the template and returning the cluster
+func (dc *DrainConsumer) add(tokens []string) *drainCluster {
+	node := dc.leaf(tokens)
+	cluster := dc.match(node, tokens)
+	if cluster == nil {
+		cluster = &drainCluster{
+			template: append([]string(nil), tokens...),
+		}
+		node.clusters = append(node.clusters, cluster)
+		dc.clusters = append(dc.clusters, cluster)
+	}
+
+	for i, t := range cluster.template {
+		if t != tokens[i] {
+			cluster.template[i] = drainWildcard
+		}
+	}
+
+	cluster.size++
+	return cluster
+}
+
+// drainSentence fills the wildcards of a template with the fields of a line, reporting false when
+// the line does not fit the template
+func drainSentence(input []rune, fields []string, spans []Span, template []string) (Sentence, bool) {
+	if len(fields) != len(template) {
+		return Sentence{}, false
+	}
+
+	var params []Token
+	var paramSpans []Span
+	for i, t := range template {
+		if t == drainWildcard {
+			params = append(params, Token(fields[i]))
+			paramSpans = append(paramSpans, spans[i])
+		} else if t != fields[i] {
+			return Sentence{}, false
+		}
+	}
+
+	// Templates generalise as lines join them. Keying by the template rather than the cluster
+	// gives every key fixed positions, and the same key to the same template in every run.
+	mask := LogMask(strings.Join(template, " "))
+	fingerprint := TemplateFingerprint(string(mask))
+	return Sentence{
+		Tokens:      params,
+		Spans:       paramSpans,
+		Mask:        mask,
+		Line:        input,
+		Fingerprint: fingerprint,
+		TemplateID:  fingerprint.String(),
+	}, true
+}
+
+// DrainSentence masks a line with a template of the drain consumer, reporting false when the line
+// does not fit the template
+func DrainSentence(input []rune, template LogMask) (Sentence, bool) {
+	fields, spans := splitFields(input)
+	return drainSentence(input, fields, spans, strings.Split(string(template), " "))
+}
+
+func (dc *DrainConsumer) Mask(input []rune) (Sentence, error) {
+	fields, spans := splitFields(input)
+	cluster := dc.add(fields)
+
+	sentence, _ := drainSentence(input, fields, spans, cluster.template)
+	return sentence, nil
+}
+
+// Consume runs on a single goroutine as the parse tree is not safe for concurrent use
+func (dc *DrainConsumer) Consume(in chan []rune) (chan Sentence, error) {
+	sentenceChan := make(chan Sentence, 100)
+
+	go func() {
+		defer close(sentenceChan)
+
+		for log := range in {
+			sentence, err := dc.Mask(log)
+			if err != nil {
+				fmt.Println("consumer error with drain")
+			}
+
+			sentenceChan <- sentence
+		}
+	}()
+
+	return sentenceChan, nil
+}
+
+// Report writes the current template of every cluster with its ID and the number of lines the
+// cluster absorbed
+func (dc *DrainConsumer) Report(filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	defer writer.Flush()
+
+	for _, c := range dc.clusters {
+		template := strings.Join(c.template, " ")
+		_, err := fmt.Fprintf(writer, "%s\t%d\t%s\n", TemplateFingerprint(template), c.size, template)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// DrainConsumerTestSuite provides test suite for DrainConsumer
+type DrainConsumerTestSuite struct {
+	suite.Suite
+	consumer *DrainConsumer
+}
+
+func (suite *DrainConsumerTestSuite) SetupTest() {
+	suite.consumer = NewDrainConsumer(defaultDrainDepth, defaultDrainSimilarity, defaultDrainMaxChildren)
+}
+
+func (suite *DrainConsumerTestSuite) TestFirstLineBecomesTemplate() {
+	sentence, err := suite.consumer.Mask([]rune("user alice logged in"))
+
+	suite.NoError(err)
+	suite.Equal(LogMask("user alice logged in"), sentence.Mask)
+	suite.Equal(TemplateFingerprint("user alice logged in"), sentence.Fingerprint)
+	suite.Equal(sentence.Fingerprint.String(), sentence.TemplateID)
+	suite.Len(sentence.Tokens, 0)
+}
+
+func (suite *DrainConsumerTestSuite) TestSimilarLinesShareTemplate() {
+	suite.consumer.Mask([]rune("login succeeded for alice"))
+	sentence, err := suite.consumer.Mask([]rune("login succeeded for bob"))
+
+	suite.NoError(err)
+	suite.Equal(LogMask("login succeeded for <*>"), sentence.Mask)
+	suite.Equal(TemplateFingerprint("login succeeded for <*>"), sentence.Fingerprint)
+	suite.Equal([]Token{Token("bob")}, sentence.Tokens)
+	suite.Equal([]Span{{Start: 20, End: 23}}, sentence.Spans)
+}
+
+func (suite *DrainConsumerTestSuite) TestFingerprintFollowsTemplate() {
+	// The template of the first line is generalised by the second, which gives it a new key with
+	// a position for every token
+	lines := []string{"job 1 finished", "job 2 finished", "job 3 finished"}
+	var sentences []Sentence
+	for _, line := range lines {
+		sentence, err := suite.consumer.Mask([]rune(line))
+		suite.NoError(err)
+		suite.Len(sentence.Tokens, strings.Count(string(sentence.Mask), drainWildcard))
+		sentences = append(sentences, sentence)
+	}
+
+	suite.NotEqual(sentences[0].Fingerprint, sentences[1].Fingerprint)
+	suite.Equal(sentences[1].Fingerprint, sentences[2].Fingerprint)
+
+	// Keys follow the template, not the order clusters appear in
+	other := NewDrainConsumer(defaultDrainDepth, defaultDrainSimilarity, defaultDrainMaxChildren)
+	other.Mask([]rune("disk full"))
+	other.Mask([]rune("job 7 finished"))
+	sentence, _ := other.Mask([]rune("job 8 finished"))
+	suite.Equal(sentences[2].Fingerprint, sentence.Fingerprint)
+}
+
+func (suite *DrainConsumerTestSuite) TestDrainSentence() {
+	sentence, ok := DrainSentence([]rune("job  42 finished"), LogMask("job <*> finished"))
+	suite.True(ok)
+	suite.Equal([]Token{Token("42")}, sentence.Tokens)
+	suite.Equal([]Span{{Start: 5, End: 7}}, sentence.Spans)
+	suite.Equal(TemplateFingerprint("job <*> finished"), sentence.Fingerprint)
+
+	_, ok = DrainSentence([]rune("job 42 failed"), LogMask("job <*> finished"))
+	suite.False(ok)
+}
+
+func (suite *DrainConsumerTestSuite) TestLiteralLettersAreNotPlaceholders() {
+	suite.consumer.Mask([]rune("job 1 finished by XYZ"))
+	sentence, _ := suite.consumer.Mask([]rune("job 2 finished by XYZ"))
+
+	candidate := ContextCandidate{Mask: sentence.Mask, Known: PairLabels(sentence)}
+	suite.Equal(1, candidate.ExpectedLabels())
+}
+
+func (suite *DrainConsumerTestSuite) TestDifferentLengthsDoNotMerge() {
+	first, _ := suite.consumer.Mask([]rune("user alice logged in"))
+	second, _ := suite.consumer.Mask([]rune("user alice logged in twice"))
+
+	suite.NotEqual(first.TemplateID, second.TemplateID)
+}
+
+func (suite *DrainConsumerTestSuite) TestDissimilarLinesDoNotMerge() {
+	first, _ := suite.consumer.Mask([]rune("cache miss for key"))
+	second, _ := suite.consumer.Mask([]rune("cache evicted oldest entry"))
+
+	suite.NotEqual(first.TemplateID, second.TemplateID)
+}
+
+func (suite *DrainConsumerTestSuite) TestNumericTokensRouteTogether() {
+	// Digits in the routing prefix are treated as wildcards so timestamps do not split templates
+	suite.consumer.Mask([]rune("1702 D PowerManagerService: release lock=1"))
+	sentence, _ := suite.consumer.Mask([]rune("2856 D PowerManagerService: release lock=2"))
+
+	suite.Equal(LogMask("<*> D PowerManagerService: release <*>"), sentence.Mask)
+	suite.Equal([]Token{Token("2856"), Token("lock=2")}, sentence.Tokens)
+}
+
+func (suite *DrainConsumerTestSuite) TestMaxChildrenFallsBackToWildcard() {
+	consumer := NewDrainConsumer(defaultDrainDepth, defaultDrainSimilarity, 1)
+	consumer.Mask([]rune("alpha one"))
+	consumer.Mask([]rune("beta two"))
+
+	node := consumer.root.children["2"]
+	suite.Len(node.children, 2)
+	suite.Contains(node.children, drainWildcard)
+}
+
+func (suite *DrainConsumerTestSuite) TestConsumeChannel() {
+	input := make(chan []rune, 3)
+	input <- []rune("job 1 finished")
+	input <- []rune("job 2 finished")
+	input <- []rune("disk full")
+	close(input)
+
+	output, err := suite.consumer.Consume(input)
+	suite.NoError(err)
+
+	var results []Sentence
+	for sentence := range output {
+		results = append(results, sentence)
+	}
+
+	suite.Len(results, 3)
+	suite.Equal(LogMask("job <*> finished"), results[1].Mask)
+	suite.NotEqual(results[1].TemplateID, results[2].TemplateID)
+}
+
+func (suite *DrainConsumerTestSuite) TestReport() {
+	suite.consumer.Mask([]rune("job 1 finished"))
+	suite.consumer.Mask([]rune("job 2 finished"))
+
+	tmpDir, err := os.MkdirTemp("", "drain_test_*")
+	suite.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	reportFile := filepath.Join(tmpDir, "templates.txt")
+	suite.NoError(suite.consumer.Report(reportFile))
+
+	content, err := os.ReadFile(reportFile)
+	suite.NoError(err)
+	suite.Equal(TemplateFingerprint("job <*> finished").String()+"\t2\tjob <*> finished", strings.TrimSpace(string(content)))
+}
+
+func TestDrainConsumerTestSuite(t *testing.T) {
+	suite.Run(t, new(DrainConsumerTestSuite))
+}
+
+func BenchmarkDrainConsumerMask(b *testing.B) {
+	consumer := NewDrainConsumer(defaultDrainDepth, defaultDrainSimilarity, defaultDrainMaxChildren)
+	input := []rune("03-17 16:13:38.936  1702 14638 D PowerManagerService: release:lock=189667585")
+
+	for i := 0; i < b.N; i++ {
+		_, _ = consumer.Mask(input)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// FileStore is a MemoryStore persisted to an append-only file of JSON records, one per write.
+// Opening the file replays it, so the last record of a key wins. Once the file holds more than
+// compactRatio records per key it is compacted to a single record per key. Records of another
+// mask version are kept as they are, so a run of that version still finds them.
+const (
+	compactRatio   = 2
+	compactMinimum = 64 // Records below which the file is never compacted
+)
+
+type fileRecord[T any] struct {
+	MaskVersion int    `json:"mask_version"`
+	Key         string `json:"key"`
+	Value       T      `json:"value"`
+}
+
+type FileStore[T any] struct {
+	*MemoryStore[T]
+	filename string
+	file     *os.File
+	records  int      // Records in the file, compacted or not
+	stale    [][]byte // Records of another mask version skipped when opening, rewritten by compaction
+}
+
+// OpenFileStore loads the store kept in filename, creating it when missing. Records of another
+// mask version are skipped but kept in the file.
+func OpenFileStore[T any](filename string) (*FileStore[T], error) {
+	fs := &FileStore[T]{
+		MemoryStore: &MemoryStore[T]{
+			data: make(map[Fingerprint]T),
+		},
+		filename: filename,
+	}
+
+	if err := fs.load(); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.file = file
+	fs.MemoryStore.journal = fs.append
+	return fs, nil
+}
+
+func (fs *FileStore[T]) load() error {
+	file, err := os.Open(fs.filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// The last stale record of a key and version wins as well
+	staleIndex := make(map[string]int)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		fs.records++
+
+		var record fileRecord[T]
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return fmt.Errorf("%s line %d: %w", fs.filename, line, err)
+		}
+
+		if record.MaskVersion != maskVersion {
+			raw := append(append([]byte(nil), scanner.Bytes()...), '\n')
+			id := fmt.Sprintf("%d/%s", record.MaskVersion, record.Key)
+			if i, ok := staleIndex[id]; ok {
+				fs.stale[i] = raw
+				continue
+			}
+
+			staleIndex[id] = len(fs.stale)
+			fs.stale = append(fs.stale, raw)
+			continue
+		}
+
+		key, err := ParseFingerprint(record.Key)
+		if err != nil {
+			return fmt.Errorf("%s line %d: %w", fs.filename, line, err)
+		}
+
+		fs.data[key] = record.Value
+	}
+
+	return scanner.Err()
+}
+
+func encodeRecord[T any](key Fingerprint, value T) ([]byte, error) {
+	encoded, err := json.Marshal(fileRecord[T]{MaskVersion: maskVersion, Key: key.String(), Value: value})
+	if err != nil {
+		return nil, err
+	}
+
+	return append(encoded, '\n'), nil
+}
+
+// append journals a write, called by the memory store while it is locked
+func (fs *FileStore[T]) append(key Fingerprint, value T) error {
+	record, err := encodeRecord(key, value)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fs.file.Write(record); err != nil {
+		return err
+	}
+
+	fs.records++
+	if fs.records > compactMinimum && fs.records > compactRatio*(len(fs.data)+len(fs.stale)) {
+		return fs.compact()
+	}
+
+	return nil
+}
+
+// compact rewrites the file with the stale records and one record per key and swaps it in, the
+// memory store must be locked
+func (fs *FileStore[T]) compact() error {
+	compacted := fs.filename + ".compact"
+	file, err := os.Create(compacted)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(file)
+	for _, record := range fs.stale {
+		if _, err := writer.Write(record); err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	for key, value := range fs.data {
+		record, err := encodeRecord(key, value)
+		if err != nil {
+			file.Close()
+			return err
+		}
+
+		if _, err := writer.Write(record); err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(compacted, fs.filename); err != nil {
+		return err
+	}
+
+	// Later records go to the compacted file
+	fs.file.Close()
+	fs.file, err = os.OpenFile(fs.filename, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	fs.records = len(fs.stale) + len(fs.data)
+	return nil
+}
+
+// Compact rewrites the file with one record per key, keeping the records of other mask versions
+func (fs *FileStore[T]) Compact() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.compact()
+}
+
+// Stale returns how many records of another mask version were skipped when opening
+func (fs *FileStore[T]) Stale() int {
+	return len(fs.stale)
+}
+
+// Close compacts the file and closes it
+func (fs *FileStore[T]) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.journal = nil
+	if err := fs.compact(); err != nil {
+		fs.file.Close()
+		return err
+	}
+
+	return fs.file.Close()
+}
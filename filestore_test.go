@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// FileStoreTestSuite provides test suite for FileStore
+type FileStoreTestSuite struct {
+	suite.Suite
+	filename string
+}
+
+func (suite *FileStoreTestSuite) SetupTest() {
+	suite.filename = filepath.Join(suite.T().TempDir(), "store.jsonl")
+}
+
+func (suite *FileStoreTestSuite) countRecords() int {
+	file, err := os.Open(suite.filename)
+	suite.Require().NoError(err)
+	defer file.Close()
+
+	var records int
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		records++
+	}
+
+	return records
+}
+
+func (suite *FileStoreTestSuite) TestContextsSurviveReopening() {
+	key := FingerprintOf(LogMask("Y=Y"))
+	store, err := OpenFileStore[Context](suite.filename)
+	suite.Require().NoError(err)
+	suite.NoError(store.Put(key, Context{labels: []string{"key", "pid"}, mask: LogMask("Y=Y")}))
+	suite.NoError(store.Close())
+
+	reopened, err := OpenFileStore[Context](suite.filename)
+	suite.Require().NoError(err)
+	defer reopened.Close()
+
+	context, err := reopened.Get(key)
+	suite.NoError(err)
+	suite.Equal([]string{"key", "pid"}, context.labels)
+	suite.Equal(LogMask("Y=Y"), context.mask)
+}
+
+func (suite *FileStoreTestSuite) TestLastWriteWins() {
+	key := FingerprintOf(LogMask("Y Y"))
+	store, err := OpenFileStore[bool](suite.filename)
+	suite.Require().NoError(err)
+	suite.NoError(store.Put(key, true))
+	suite.NoError(store.Put(key, false))
+	_, written := store.Update(key, func(value bool, exists bool) (bool, bool) {
+		return !value, exists
+	})
+	suite.True(written)
+
+	// Every write is journaled before the store is closed
+	suite.Equal(3, suite.countRecords())
+
+	reopened, err := OpenFileStore[bool](suite.filename)
+	suite.Require().NoError(err)
+	defer reopened.Close()
+
+	value, err := reopened.Get(key)
+	suite.NoError(err)
+	suite.True(value)
+	suite.NoError(store.Close())
+}
+
+func (suite *FileStoreTestSuite) TestCompactsRepeatedWrites() {
+	key := FingerprintOf(LogMask("Y Y"))
+	store, err := OpenFileStore[bool](suite.filename)
+	suite.Require().NoError(err)
+
+	for i := 0; i < compactMinimum*2; i++ {
+		suite.NoError(store.Put(key, i%2 == 0))
+	}
+	suite.Less(suite.countRecords(), compactMinimum+2)
+
+	suite.NoError(store.Close())
+	suite.Equal(1, suite.countRecords())
+}
+
+func (suite *FileStoreTestSuite) TestKeepsStaleRecords() {
+	stale := `{"mask_version":0,"key":"00000000000000ff","value":true}`
+	content := `{"mask_version":0,"key":"00000000000000ff","value":false}` + "\n" + stale + "\n" +
+		fmt.Sprintf(`{"mask_version":%d,"key":"00000000000000fe","value":true}`, maskVersion) + "\n"
+	suite.Require().NoError(os.WriteFile(suite.filename, []byte(content), 0644))
+
+	store, err := OpenFileStore[bool](suite.filename)
+	suite.Require().NoError(err)
+	suite.Equal(1, store.Stale())
+	suite.Len(store.Keys(), 1)
+
+	// Compaction keeps the latest record of the other version for a run of that version
+	suite.NoError(store.Close())
+	suite.Equal(2, suite.countRecords())
+
+	written, err := os.ReadFile(suite.filename)
+	suite.NoError(err)
+	suite.Contains(string(written), stale)
+}
+
+func (suite *FileStoreTestSuite) TestRejectsCorruptRecords() {
+	suite.Require().NoError(os.WriteFile(suite.filename, []byte("{not json\n"), 0644))
+
+	_, err := OpenFileStore[bool](suite.filename)
+	suite.ErrorContains(err, "line 1")
+}
+
+func (suite *FileStoreTestSuite) TestImplementsStore() {
+	var _ Store[Context] = &FileStore[Context]{}
+	var _ Store[bool] = &FileStore[bool]{}
+}
+
+func TestFileStoreTestSuite(t *testing.T) {
+	suite.Run(t, new(FileStoreTestSuite))
+}
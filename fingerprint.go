@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"unicode/utf8"
+)
+
+// Fingerprints identify a mask with 64 bits instead of the mask itself. They are an FNV-1a hash
+// of the normalised mask encoded as UTF-8, seeded with a version so that fingerprints only change
+// when fingerprintVersion is bumped, never between runs or machines.
+const (
+	fingerprintVersion = 1
+
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+type Fingerprint uint64
+
+// FingerprintOf hashes a mask without allocating. Runs of Ys are hashed as a single Y so
+// compressed and uncompressed masks of the same line share a fingerprint.
+func FingerprintOf(mask LogMask) Fingerprint {
+	hash := uint64(fnvOffset64)
+	hash ^= fingerprintVersion
+	hash *= fnvPrime64
+
+	var buf [utf8.UTFMax]byte
+	for i, r := range mask {
+		if r == topLevelAlphaNumericContent && i > 0 && mask[i-1] == topLevelAlphaNumericContent {
+			continue
+		}
+
+		n := utf8.EncodeRune(buf[:], r)
+		for _, b := range buf[:n] {
+			hash ^= uint64(b)
+			hash *= fnvPrime64
+		}
+	}
+
+	return Fingerprint(hash)
+}
+
+// TemplateFingerprint keys the templates of consumers that assign their own IDs, whose masks are
+// literal text. The template is hashed as it is after a zero byte, which no mask starts with, so
+// runs of Ys are kept and templates never share a key with a symbol mask.
+func TemplateFingerprint(template string) Fingerprint {
+	hash := uint64(fnvOffset64)
+	hash ^= fingerprintVersion
+	hash *= fnvPrime64
+
+	hash *= fnvPrime64 // Zero byte
+	for i := 0; i < len(template); i++ {
+		hash ^= uint64(template[i])
+		hash *= fnvPrime64
+	}
+
+	return Fingerprint(hash)
+}
+
+// String prints the fingerprint as a fixed width template ID
+func (f Fingerprint) String() string {
+	return fmt.Sprintf("%016x", uint64(f))
+}
+
+func ParseFingerprint(s string) (Fingerprint, error) {
+	value, err := strconv.ParseUint(s, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid template ID %q: %w", s, err)
+	}
+
+	return Fingerprint(value), nil
+}
+
+func (m LogMask) String() string {
+	return string(m)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// FingerprintTestSuite provides test suite for mask fingerprints
+type FingerprintTestSuite struct {
+	suite.Suite
+	consumer *MaskConsumer
+}
+
+func (suite *FingerprintTestSuite) SetupTest() {
+	suite.consumer = NewMaskConsumer()
+}
+
+func (suite *FingerprintTestSuite) TestStableAcrossRuns() {
+	// Changing this value orphans every stored registry, bump fingerprintVersion instead
+	mask := LogMask(`Y-Y Y:Y:Y.Y  Y Y Y Y: Y:Y=Y, Y=Y, Y="X", Y=Y", Y=Y{X}, Y=Y, Y=Y`)
+
+	suite.Equal("07b2bab9f93fe8b6", FingerprintOf(mask).String())
+}
+
+func (suite *FingerprintTestSuite) TestNormalisesYRuns() {
+	suite.Equal(FingerprintOf(LogMask("Y-Y_Y")), FingerprintOf(LogMask("YYYY-YY_Y")))
+}
+
+func (suite *FingerprintTestSuite) TestDistinguishesMasks() {
+	masks := []string{"", "Y", "X", "Y=Y", "Y:Y", `Y="X"`, "Y=Y, Y=Y", "RY=Y, EY=Y", "Yñ", "Y🚀"}
+
+	seen := make(map[Fingerprint]string)
+	for _, mask := range masks {
+		fingerprint := FingerprintOf(LogMask(mask))
+		suite.NotContains(seen, fingerprint, "%q collides with %q", mask, seen[fingerprint])
+		seen[fingerprint] = mask
+	}
+}
+
+func (suite *FingerprintTestSuite) TestParseRoundTrip() {
+	fingerprint := FingerprintOf(LogMask("Y=Y"))
+
+	parsed, err := ParseFingerprint(fingerprint.String())
+	suite.NoError(err)
+	suite.Equal(fingerprint, parsed)
+
+	_, err = ParseFingerprint("not-a-template")
+	suite.Error(err)
+}
+
+func (suite *FingerprintTestSuite) TestConsumerSetsFingerprint() {
+	first, err := suite.consumer.Mask([]rune("pid=1702"))
+	suite.NoError(err)
+	second, err := suite.consumer.Mask([]rune("uid=1000"))
+	suite.NoError(err)
+
+	suite.Equal(FingerprintOf(first.Mask), first.Fingerprint)
+	suite.Equal(first.Fingerprint, second.Fingerprint)
+}
+
+func TestFingerprintTestSuite(t *testing.T) {
+	suite.Run(t, new(FingerprintTestSuite))
+}
+
+func TestFingerprintDoesNotAllocate(t *testing.T) {
+	mask := LogMask(`Y-Y Y:Y:Y.Y  Y Y Y Y: Y:Y=Y, Y=Y, Y="X", Y=Y", Y=Y{X}, Y=Y, Y=Y`)
+
+	if allocs := testing.AllocsPerRun(100, func() { FingerprintOf(mask) }); allocs != 0 {
+		t.Errorf("FingerprintOf allocated %v times per mask", allocs)
+	}
+}
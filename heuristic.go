@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// HeuristicProvider labels masks offline from the shapes of their sample tokens: dates, times,
+// timestamps, IP addresses, log levels, hex flags, numeric ids, bracketed components and pair keys.
+// Every sample is labelled on its own and each position takes the label most samples agree on.
+// Other words are labelled text, or value when they differ between samples.
+type HeuristicProvider struct {
+	mu     sync.Mutex // Consumers reuse their scratch buffers, so samples are masked one at a time
+	plain  *MaskConsumer
+	folded *MaskConsumer
+}
+
+func NewHeuristicProvider() *HeuristicProvider {
+	return &HeuristicProvider{
+		plain:  NewMaskConsumer(),
+		folded: NewMaskConsumer(WithRepetitionFolding()),
+	}
+}
+
+// Shapes of the runs of tokens joined by '-', ':', '.', '/' or ',' such as "03-17" or "16:13:38.936"
+var (
+	timestampShape = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}T\d{2}:\d{2}(:\d{2})?([.,]\d+)?Z?$`)
+	dateShape      = regexp.MustCompile(`^(\d{4}[-/]\d{1,2}[-/]\d{1,2}|\d{1,2}[-/]\d{1,2}([-/]\d{2,4})?)$`)
+	timeShape      = regexp.MustCompile(`^\d{1,2}:\d{2}(:\d{2})?([.,]\d+)?$`)
+	ipShape        = regexp.MustCompile(`^\d{1,3}(\.\d{1,3}){3}(:\d{1,5})?$`)
+	hexShape       = regexp.MustCompile(`^0[xX][0-9a-fA-F]+$`)
+	numberShape    = regexp.MustCompile(`^\d+$`)
+	hexIDShape     = regexp.MustCompile(`^[0-9a-fA-F]{8,}$`)
+)
+
+var logLevels = map[string]bool{
+	"TRACE": true, "DEBUG": true, "INFO": true, "NOTICE": true, "WARN": true, "WARNING": true,
+	"ERROR": true, "ERR": true, "FATAL": true, "CRITICAL": true, "CRIT": true, "PANIC": true,
+}
+
+// Android style single letter levels only count in upper case
+var shortLogLevels = map[string]bool{"V": true, "D": true, "I": true, "W": true, "E": true, "F": true}
+
+// Symbols joining the tokens of a date, time or address
+func isJoiner(r rune) bool {
+	return r == '-' || r == ':' || r == '.' || r == '/' || r == ','
+}
+
+// group returns the first and last of the tokens joined to token i without whitespace and the text
+// they span
+func group(s Sentence, i int) (int, int, string) {
+	joined := func(a, b int) bool {
+		gap := s.Line[s.Spans[a].End:s.Spans[b].Start]
+		return len(gap) == 1 && isJoiner(gap[0])
+	}
+
+	first, last := i, i
+	for first > 0 && joined(first-1, first) {
+		first--
+	}
+
+	for last < len(s.Spans)-1 && joined(last, last+1) {
+		last++
+	}
+
+	text := string(s.Line[s.Spans[first].Start:s.Spans[last].End])
+	return first, last, text
+}
+
+func shapeOfGroup(text string) string {
+	switch {
+	case timestampShape.MatchString(text):
+		return "timestamp"
+	case ipShape.MatchString(text):
+		return "ip"
+	case dateShape.MatchString(text):
+		return "date"
+	case timeShape.MatchString(text):
+		return "time"
+	default:
+		return ""
+	}
+}
+
+func shapeOfToken(s Sentence, i int) string {
+	token := string(s.Tokens[i])
+	span := s.Spans[i]
+	switch {
+	case logLevels[strings.ToUpper(token)] || shortLogLevels[token]:
+		return "level"
+	case hexShape.MatchString(token):
+		return "flags"
+	case numberShape.MatchString(token):
+		return "id"
+	case hexIDShape.MatchString(token) && strings.ContainsAny(token, "0123456789"):
+		return "id"
+	}
+
+	// Keys of values in enclosures, "state=[ok]", are missed by pairs
+	if span.End < len(s.Line) && s.Line[span.End] == '=' {
+		return pairKeyLabel
+	}
+
+	if _, opening := enclosingSymbols[s.Line[max(span.Start-1, 0)]]; opening && span.Start > 0 {
+		if begin, end, ok := pairKey(s.Line, span.Start-1); ok {
+			return string(s.Line[begin:end])
+		}
+	}
+
+	// "[worker]" and "PowerManagerService: message" name the component that logged the line
+	if span.Start > 0 && s.Line[span.Start-1] == '[' && span.End < len(s.Line) && s.Line[span.End] == ']' {
+		return "component"
+	}
+
+	if span.End+1 < len(s.Line) && s.Line[span.End] == ':' && s.Line[span.End+1] == ' ' {
+		return "component"
+	}
+
+	return "text"
+}
+
+// labelSample labels every token of a sentence
+func labelSample(s Sentence) []string {
+	labels := PairLabels(s)
+	if len(s.Spans) != len(s.Tokens) {
+		return labels
+	}
+
+	for i := 0; i < len(labels); i++ {
+		if labels[i] != "" {
+			continue
+		}
+
+		// Tokens of drain templates are whole fields, so a single token can have the shape as well
+		first, last, text := group(s, i)
+		if shape := shapeOfGroup(text); shape != "" {
+			for k := first; k <= last; k++ {
+				if labels[k] == "" {
+					labels[k] = shape
+				}
+			}
+			continue
+		}
+
+		labels[i] = shapeOfToken(s, i)
+	}
+
+	return labels
+}
+
+func varies(values [][]string, i int) bool {
+	for _, sample := range values[1:] {
+		if sample[i] != values[0][i] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sample masks a line the way the candidate mask was computed, reporting false for lines of
+// another mask. Drain templates are literal text, so lines are fitted to them instead.
+func (hp *HeuristicProvider) sample(line LogLine, mask LogMask) (Sentence, bool) {
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+
+	for _, consumer := range []*MaskConsumer{hp.plain, hp.folded} {
+		s, err := consumer.Mask([]rune(string(line)))
+		if err == nil && s.Fingerprint == FingerprintOf(mask) {
+			return s, true
+		}
+	}
+
+	return DrainSentence([]rune(string(line)), mask)
+}
+
+func (hp *HeuristicProvider) Contextualise(_ context.Context, input ContextCandidate) (Context, error) {
+	expected := input.ExpectedLabels()
+	votes := make([]map[string]int, expected)
+	for i := range votes {
+		votes[i] = make(map[string]int)
+	}
+
+	var order [][]string // Labels of each usable sample, ties go to the earliest sample
+	var values [][]string
+	for _, line := range input.Samples {
+		s, ok := hp.sample(line, input.Mask)
+		if !ok {
+			continue
+		}
+
+		labels := FoldLabels(labelSample(s), s.Repetitions)
+		if len(labels) != expected {
+			continue
+		}
+
+		tokens := make([]string, len(s.Tokens))
+		for i, token := range s.Tokens {
+			tokens[i] = string(token)
+		}
+
+		for i, label := range labels {
+			votes[i][label]++
+		}
+		order = append(order, labels)
+		values = append(values, FoldLabels(tokens, s.Repetitions))
+	}
+
+	if len(order) == 0 {
+		return Context{}, fmt.Errorf("%w: no sample of mask %s could be labelled", ErrPermanent, input.Mask)
+	}
+
+	labels := make([]string, expected)
+	for i := range labels {
+		for _, sampleLabels := range order {
+			if votes[i][sampleLabels[i]] > votes[i][labels[i]] {
+				labels[i] = sampleLabels[i]
+			}
+		}
+
+		// Free text that differs between samples is a variable of the template
+		if labels[i] == "text" && varies(values, i) {
+			labels[i] = "value"
+		}
+	}
+
+	return Context{labels: labels}, nil
+}
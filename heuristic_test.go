@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// HeuristicProviderTestSuite provides test suite for HeuristicProvider
+type HeuristicProviderTestSuite struct {
+	suite.Suite
+	provider *HeuristicProvider
+	consumer *MaskConsumer
+}
+
+func (suite *HeuristicProviderTestSuite) SetupTest() {
+	suite.provider = NewHeuristicProvider()
+	suite.consumer = NewMaskConsumer()
+}
+
+func (suite *HeuristicProviderTestSuite) candidate(lines ...string) ContextCandidate {
+	first, err := suite.consumer.Mask([]rune(lines[0]))
+	suite.Require().NoError(err)
+
+	candidate := ContextCandidate{Mask: first.Mask, Known: PairLabels(first)}
+	for _, line := range lines {
+		candidate.Samples = append(candidate.Samples, LogLine(line))
+	}
+
+	return candidate
+}
+
+func (suite *HeuristicProviderTestSuite) labels(lines ...string) []string {
+	context, err := suite.provider.Contextualise(context.Background(), suite.candidate(lines...))
+	suite.Require().NoError(err)
+	return context.labels
+}
+
+func (suite *HeuristicProviderTestSuite) TestAndroidLine() {
+	labels := suite.labels(
+		"03-17 16:13:38.936  1702 14638 D PowerManagerService: release:lock=189667585, flg=0x0",
+		"03-17 16:13:39.012  1702 14640 D PowerManagerService: release:lock=189667586, flg=0x1",
+	)
+
+	suite.Equal([]string{
+		"date", "date",
+		"time", "time", "time", "time",
+		"id", "id", "level", "component",
+		"text", "key", "lock", "key", "flg",
+	}, labels)
+}
+
+func (suite *HeuristicProviderTestSuite) TestShapes() {
+	labels := suite.labels(
+		"2024-01-02T10:11:12.5Z ERROR [worker] from 10.0.0.1 request deadbeef42 stored",
+		"2024-01-02T10:11:13.5Z ERROR [worker] from 10.0.0.2 request deadbeef43 stored",
+	)
+
+	suite.Equal([]string{
+		"timestamp", "timestamp", "timestamp", "timestamp", "timestamp", "timestamp",
+		"level", "component", "text",
+		"ip", "ip", "ip", "ip",
+		"text", "id", "text",
+	}, labels)
+}
+
+func (suite *HeuristicProviderTestSuite) TestEnclosedPairValues() {
+	suite.Equal([]string{"key", "state"}, suite.labels("state=[ok]"))
+}
+
+func (suite *HeuristicProviderTestSuite) TestVaryingTextIsValue() {
+	suite.Equal([]string{"text", "value", "text", "text"}, suite.labels("user alice logged in", "user bob logged in"))
+}
+
+func (suite *HeuristicProviderTestSuite) TestMajorityWins() {
+	// A user named like a level in one sample does not make the position a level
+	labels := suite.labels("user alice left", "user INFO left", "user bob left")
+	suite.Equal("value", labels[1])
+}
+
+func (suite *HeuristicProviderTestSuite) TestFoldedMask() {
+	folding := NewMaskConsumer(WithRepetitionFolding())
+	sentence, err := folding.Mask([]rune("users a=1, b=2, c=3;"))
+	suite.Require().NoError(err)
+
+	candidate := ContextCandidate{
+		Mask:    sentence.Mask,
+		Samples: []LogLine{LogLine("users a=1, b=2, c=3;")},
+		Known:   FoldLabels(PairLabels(sentence), sentence.Repetitions),
+	}
+	context, err := suite.provider.Contextualise(context.Background(), candidate)
+	suite.Require().NoError(err)
+	suite.Len(context.labels, candidate.ExpectedLabels())
+}
+
+func (suite *HeuristicProviderTestSuite) TestSamplesOfAnotherMask() {
+	candidate := ContextCandidate{Mask: LogMask("Y Y"), Samples: []LogLine{LogLine("a=b, c=d")}, Known: []string{"", ""}}
+	_, err := suite.provider.Contextualise(context.Background(), candidate)
+	suite.ErrorIs(err, ErrPermanent)
+}
+
+func (suite *HeuristicProviderTestSuite) TestDrainTemplate() {
+	drain := NewDrainConsumer(defaultDrainDepth, defaultDrainSimilarity, defaultDrainMaxChildren)
+	lines := []string{"job 1 finished at 10:15:02", "job 2 finished at 10:15:09", "job 3 finished at 10:16:40"}
+	var sentence Sentence
+	for _, line := range lines {
+		sentence, _ = drain.Mask([]rune(line))
+	}
+
+	candidate := ContextCandidate{Mask: sentence.Mask, Known: PairLabels(sentence)}
+	for _, line := range lines {
+		candidate.Samples = append(candidate.Samples, LogLine(line))
+	}
+
+	context, err := suite.provider.Contextualise(context.Background(), candidate)
+	suite.Require().NoError(err)
+	suite.Equal([]string{"id", "time"}, context.labels)
+}
+
+func (suite *HeuristicProviderTestSuite) TestFallsBackWhenProviderFails() {
+	provider := NewFakeContextProvider()
+	provider.SetError(errors.New("unavailable"))
+	maskRegistry := NewMaskStatusStore()
+	contextualiser := NewSentenceContextualiser(provider, NewContextStore(), maskRegistry, NewTemplateStore(), nil, false, nil,
+		WithRetry(RetryPolicy{Attempts: 1}), WithFallbackProvider(suite.provider))
+
+	sentence, err := suite.consumer.Mask([]rune("user alice logged in"))
+	suite.Require().NoError(err)
+	sentence.Priority = true
+	maskRegistry.Put(sentence.Fingerprint, MaskStatus{State: MaskCollecting})
+
+	registered := make(chan Sentence, 1)
+	suite.NoError(contextualiser.accumulate(sentence, registered, nil))
+	contextualiser.pending.Wait()
+
+	suite.Equal(sentence.Line, (<-registered).Line)
+	suite.True(isRegistered(maskRegistry, sentence.Fingerprint))
+}
+
+func TestHeuristicProviderTestSuite(t *testing.T) {
+	suite.Run(t, new(HeuristicProviderTestSuite))
+}
@@ -1,14 +1,67 @@
 package main
 
-import "fmt"
+import (
+	"encoding/json"
+	"fmt"
+)
 
 type Context struct {
 	labels []string
+	mask   LogMask // Mask the labels belong to, so a cached context can restore its template
+}
+
+type contextJSON struct {
+	Labels []string `json:"labels"`
+	Mask   string   `json:"mask,omitempty"`
+}
+
+func (c Context) MarshalJSON() ([]byte, error) {
+	return json.Marshal(contextJSON{Labels: c.labels, Mask: string(c.mask)})
+}
+
+func (c *Context) UnmarshalJSON(data []byte) error {
+	var decoded contextJSON
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+
+	c.labels = decoded.Labels
+	if decoded.Mask != "" {
+		c.mask = LogMask(decoded.Mask)
+	}
+	return nil
 }
 
 // Key Value Map of Labels to their underlying token
 type LabelledTokens struct {
-	data map[TokenLabel][]Token
+	data     map[TokenLabel][]Token
+	template Fingerprint // Mask the line was labelled under
+}
+
+// Key of the template ID in labelled records, it takes precedence over a label of the same name
+const templateIDKey = "template_id"
+
+// Values returns the tokens of every label as strings
+func (lt LabelledTokens) Values() map[string][]string {
+	values := make(map[string][]string, len(lt.data))
+	for label, tokens := range lt.data {
+		for _, token := range tokens {
+			values[string(label)] = append(values[string(label)], string(token))
+		}
+	}
+
+	return values
+}
+
+// Record returns the values of every label with the template ID of the line under templateIDKey
+func (lt LabelledTokens) Record() map[string]any {
+	record := make(map[string]any, len(lt.data)+1)
+	for label, values := range lt.Values() {
+		record[label] = values
+	}
+	record[templateIDKey] = lt.template.String()
+
+	return record
 }
 
 type Labeler interface {
@@ -27,21 +80,48 @@ func NewTokenLabeller(c *MemoryStore[Context]) *TokenLabeller {
 
 func (te *TokenLabeller) LabelTokens(context Context, sentence Sentence) (LabelledTokens, error) {
 	results := LabelledTokens{
-		data: make(map[TokenLabel][]Token),
+		data:     make(map[TokenLabel][]Token),
+		template: sentence.Fingerprint,
 	}
 
+	// Labels describe the folded mask, repeat them for every repetition of a folded unit
+	labels := ExpandLabels(context.labels, sentence.Repetitions)
+
 	// Reject any context that do not match up 100% with tokens
-	// Need to add retry handling here (braintrust client in contextualiser should handle the retry for us)
-	if len(context.labels) != len(sentence.Tokens) {
+	// The contextualiser validates label counts, so this only catches contexts of another mask version
+	if len(labels) != len(sentence.Tokens) {
 		return results, fmt.Errorf(
 			"token/label count mismatch: %d tokens, %d labels",
 			len(sentence.Tokens),
-			len(context.labels),
+			len(labels),
 		)
 	}
 
+	// Pair values are labelled with the keys of this line rather than those of the contextualised samples
+	labels = OverlayPairLabels(labels, sentence)
+
+	// Structured fields replace the tokens they were parsed from with their own named values
+	var covered []bool
+	if len(sentence.Fields) > 0 {
+		covered = make([]bool, len(sentence.Tokens))
+	}
+
+	for _, field := range sentence.Fields {
+		for i := field.First; i < field.Last && i < len(covered); i++ {
+			covered[i] = true
+		}
+
+		tokenLabel := TokenLabel(field.Key)
+		results.data[tokenLabel] = append(results.data[tokenLabel], Token(field.Value))
+	}
+
 	// The order of labels and tokens should be the same.
-	for i, label := range context.labels {
+	// Tokens of a folded unit are appended in order, so their position under a label is their repetition index.
+	for i, label := range labels {
+		if covered != nil && covered[i] {
+			continue
+		}
+
 		tokenLabel := TokenLabel(label)
 		results.data[tokenLabel] = append(results.data[tokenLabel], sentence.Tokens[i])
 	}
@@ -57,18 +137,17 @@ func (te *TokenLabeller) Ingest(input chan Sentence) (chan LabelledTokens, error
 		defer close(output)
 
 		for sentence := range input {
-			m := string(sentence.Mask)
-			c, err := te.contextRegistry.Get(m)
+			c, err := te.contextRegistry.Get(sentence.Fingerprint)
 			// Ephemeral error should not stop processing other logs
 			if err != nil {
-				fmt.Println("error fetching context for mask") // Format mask variable into log
+				fmt.Printf("error fetching context for mask %s\n", sentence.Fingerprint)
 				continue
 			}
 
 			data, err := te.LabelTokens(c, sentence)
 			// Ephemeral error should not stop processing other logs
 			if err != nil {
-				fmt.Println("error labelling tokens using context") // Format mask variable into log
+				fmt.Printf("error labelling tokens using context for mask %s: %v\n", sentence.Fingerprint, err)
 				continue
 			}
 
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"time"
+)
+
+// Every mask moves through these states. The admin moves unseen masks to collecting, the
+// contextualiser moves collecting masks to in flight once it has enough samples and then to
+// registered or failed. Lines of registered masks are labelled, lines of failed masks take the
+// fallback path instead of accumulating again.
+type MaskState int
+
+const (
+	MaskUnseen MaskState = iota
+	MaskCollecting
+	MaskInFlight
+	MaskFailed
+	MaskRegistered
+)
+
+var maskStates = []MaskState{MaskUnseen, MaskCollecting, MaskInFlight, MaskFailed, MaskRegistered}
+
+func (s MaskState) String() string {
+	switch s {
+	case MaskUnseen:
+		return "unseen"
+	case MaskCollecting:
+		return "collecting"
+	case MaskInFlight:
+		return "in-flight"
+	case MaskFailed:
+		return "failed"
+	case MaskRegistered:
+		return "registered"
+	default:
+		return fmt.Sprintf("state(%d)", int(s))
+	}
+}
+
+type MaskStatus struct {
+	State     MaskState
+	Count     int // Lines seen with the mask
+	FirstSeen time.Time
+	LastSeen  time.Time
+	Failure   string // Reason of the last failed contextualisation
+}
+
+func (s MaskStatus) String() string {
+	status := fmt.Sprintf("%s\t%d\t%s\t%s", s.State, s.Count, s.FirstSeen.Format(time.RFC3339), s.LastSeen.Format(time.RFC3339))
+	if s.Failure != "" {
+		status += "\t" + s.Failure
+	}
+
+	return status
+}
+
+func NewMaskStatusStore() *MemoryStore[MaskStatus] {
+	return &MemoryStore[MaskStatus]{
+		data: make(map[Fingerprint]MaskStatus),
+	}
+}
+
+// transition atomically moves a mask from one of the given states to the next one, keeping its
+// counts. No states allows any current state. Returns whether the mask moved.
+func transition(store *MemoryStore[MaskStatus], key Fingerprint, next MaskState, failure string, from ...MaskState) bool {
+	_, moved := store.Update(key, func(status MaskStatus, _ bool) (MaskStatus, bool) {
+		if len(from) > 0 && !slices.Contains(from, status.State) {
+			return status, false
+		}
+
+		status.State = next
+		status.Failure = failure
+		return status, true
+	})
+
+	return moved
+}
+
+// registerMask marks a mask as registered from any state
+func registerMask(store *MemoryStore[MaskStatus], key Fingerprint) {
+	transition(store, key, MaskRegistered, "")
+}
+
+func isRegistered(store *MemoryStore[MaskStatus], key Fingerprint) bool {
+	status, err := store.Get(key)
+	return err == nil && status.State == MaskRegistered
+}
+
+// CountMaskStates returns how many masks are in each state
+func CountMaskStates(store *MemoryStore[MaskStatus]) map[MaskState]int {
+	counts := make(map[MaskState]int)
+	for _, key := range store.Keys() {
+		if status, err := store.Get(key); err == nil {
+			counts[status.State]++
+		}
+	}
+
+	return counts
+}
+
+// PrintMaskStates writes the number of masks per state on one line
+func PrintMaskStates(store *MemoryStore[MaskStatus], w io.Writer) {
+	counts := CountMaskStates(store)
+	fmt.Fprint(w, "masks:")
+	for _, state := range maskStates[1:] {
+		fmt.Fprintf(w, " %s=%d", state, counts[state])
+	}
+	fmt.Fprintln(w)
+}
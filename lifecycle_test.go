@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// LifecycleTestSuite provides test suite for mask states
+type LifecycleTestSuite struct {
+	suite.Suite
+	store *MemoryStore[MaskStatus]
+}
+
+func (suite *LifecycleTestSuite) SetupTest() {
+	suite.store = NewMaskStatusStore()
+}
+
+func (suite *LifecycleTestSuite) TestTransitionOnlyFromGivenStates() {
+	key := fp("Y Y")
+	suite.store.Put(key, MaskStatus{State: MaskCollecting, Count: 3})
+
+	suite.True(transition(suite.store, key, MaskInFlight, "", MaskCollecting))
+	suite.False(transition(suite.store, key, MaskInFlight, "", MaskCollecting), "only one caller starts contextualisation")
+
+	suite.True(transition(suite.store, key, MaskFailed, "timeout"))
+	status, err := suite.store.Get(key)
+	suite.NoError(err)
+	suite.Equal(MaskStatus{State: MaskFailed, Count: 3, Failure: "timeout"}, status)
+
+	registerMask(suite.store, key)
+	suite.True(isRegistered(suite.store, key))
+	status, _ = suite.store.Get(key)
+	suite.Empty(status.Failure)
+}
+
+func (suite *LifecycleTestSuite) TestStateNames() {
+	suite.Equal("unseen", MaskUnseen.String())
+	suite.Equal("in-flight", MaskInFlight.String())
+	suite.Equal("state(9)", MaskState(9).String())
+}
+
+func (suite *LifecycleTestSuite) TestPrintMaskStates() {
+	suite.store.Put(fp("a"), MaskStatus{State: MaskRegistered})
+	suite.store.Put(fp("b"), MaskStatus{State: MaskRegistered})
+	suite.store.Put(fp("c"), MaskStatus{State: MaskFailed})
+
+	var out bytes.Buffer
+	PrintMaskStates(suite.store, &out)
+
+	suite.Equal("masks: collecting=0 in-flight=0 failed=1 registered=2\n", out.String())
+}
+
+func TestLifecycleTestSuite(t *testing.T) {
+	suite.Run(t, new(LifecycleTestSuite))
+}
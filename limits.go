@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Provider calls are limited three ways: a pool bounds how many masks are contextualised at once,
+// a rate limiter spaces calls out, and a budget caps the calls and estimated prompt tokens of a run.
+// Masks over budget are marked failed and take the fallback path.
+
+const defaultCallWorkers = 8
+
+// ErrBudgetExhausted is returned for calls over the budget of the run
+var ErrBudgetExhausted = errors.New("contextualisation budget exhausted")
+
+// callPool runs jobs on at most workers goroutines. Workers start when jobs are queued and exit
+// once the queue is empty. Priority jobs are taken before any other queued job.
+type callPool struct {
+	mu       sync.Mutex
+	workers  int
+	running  int
+	priority []func()
+	queue    []func()
+}
+
+func newCallPool(workers int) *callPool {
+	return &callPool{workers: max(workers, 1)}
+}
+
+func (p *callPool) submit(job func(), priority bool) {
+	p.mu.Lock()
+	if priority {
+		p.priority = append(p.priority, job)
+	} else {
+		p.queue = append(p.queue, job)
+	}
+
+	if p.running >= p.workers {
+		p.mu.Unlock()
+		return
+	}
+
+	p.running++
+	p.mu.Unlock()
+	go p.work()
+}
+
+func (p *callPool) next() (func(), bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var job func()
+	switch {
+	case len(p.priority) > 0:
+		job, p.priority = p.priority[0], p.priority[1:]
+	case len(p.queue) > 0:
+		job, p.queue = p.queue[0], p.queue[1:]
+	default:
+		p.running--
+		return nil, false
+	}
+
+	return job, true
+}
+
+func (p *callPool) work() {
+	for {
+		job, ok := p.next()
+		if !ok {
+			return
+		}
+
+		job()
+	}
+}
+
+// rateLimiter spaces calls out evenly, a zero interval does not limit
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimiter(perSecond float64) *rateLimiter {
+	if perSecond <= 0 {
+		return &rateLimiter{}
+	}
+
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / perSecond)}
+}
+
+// Wait blocks until the caller may make its call
+func (l *rateLimiter) Wait() {
+	if l.interval == 0 {
+		return
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+
+	time.Sleep(wait)
+}
+
+// Budget caps the provider calls of a run, zero limits are unlimited
+type Budget struct {
+	MaxCalls  int64
+	MaxTokens int64 // Estimated prompt tokens, see estimateTokens
+	calls     atomic.Int64
+	tokens    atomic.Int64
+}
+
+// spend takes a call of the given tokens from the budget, reporting false once a limit would be
+// exceeded. Calls over budget are not counted.
+func (b *Budget) spend(tokens int64) bool {
+	if calls := b.calls.Add(1); b.MaxCalls > 0 && calls > b.MaxCalls {
+		b.calls.Add(-1)
+		return false
+	}
+
+	if total := b.tokens.Add(tokens); b.MaxTokens > 0 && total > b.MaxTokens {
+		b.tokens.Add(-tokens)
+		b.calls.Add(-1)
+		return false
+	}
+
+	return true
+}
+
+// Spent returns the calls and estimated tokens spent so far
+func (b *Budget) Spent() (int64, int64) {
+	return b.calls.Load(), b.tokens.Load()
+}
+
+// estimateTokens approximates the prompt tokens of a candidate at four characters per token
+func estimateTokens(c ContextCandidate) int64 {
+	var characters int
+	for _, value := range CandidatePrompt(c) {
+		if text, ok := value.(string); ok {
+			characters += len(text)
+		}
+	}
+
+	for _, label := range c.Known {
+		characters += len(label) + 3
+	}
+
+	return int64(characters/4 + 1)
+}
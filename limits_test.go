@@ -0,0 +1,105 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// LimitsTestSuite provides test suite for the limits of provider calls
+type LimitsTestSuite struct {
+	suite.Suite
+}
+
+func (suite *LimitsTestSuite) TestPoolBoundsConcurrency() {
+	pool := newCallPool(3)
+
+	var running, peak atomic.Int64
+	var wg sync.WaitGroup
+	wg.Add(20)
+	for i := 0; i < 20; i++ {
+		pool.submit(func() {
+			defer wg.Done()
+			now := running.Add(1)
+			for {
+				seen := peak.Load()
+				if now <= seen || peak.CompareAndSwap(seen, now) {
+					break
+				}
+			}
+
+			time.Sleep(time.Millisecond)
+			running.Add(-1)
+		}, false)
+	}
+	wg.Wait()
+
+	suite.LessOrEqual(peak.Load(), int64(3))
+}
+
+func (suite *LimitsTestSuite) TestPriorityJumpsQueue() {
+	pool := newCallPool(1)
+
+	// Hold the only worker while the queue fills up
+	hold := make(chan struct{})
+	var order []string
+	var wg sync.WaitGroup
+	wg.Add(4)
+	pool.submit(func() { <-hold; wg.Done() }, false)
+	for _, name := range []string{"first", "second"} {
+		pool.submit(func() { order = append(order, name); wg.Done() }, false)
+	}
+	pool.submit(func() { order = append(order, "priority"); wg.Done() }, true)
+	close(hold)
+	wg.Wait()
+
+	suite.Equal([]string{"priority", "first", "second"}, order)
+}
+
+func (suite *LimitsTestSuite) TestRateLimiterSpacesCalls() {
+	limiter := newRateLimiter(100)
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		limiter.Wait()
+	}
+
+	suite.GreaterOrEqual(time.Since(start), 40*time.Millisecond)
+}
+
+func (suite *LimitsTestSuite) TestBudgetLimitsCalls() {
+	budget := &Budget{MaxCalls: 2}
+	suite.True(budget.spend(10))
+	suite.True(budget.spend(10))
+	suite.False(budget.spend(10))
+
+	calls, tokens := budget.Spent()
+	suite.Equal(int64(2), calls)
+	suite.Equal(int64(20), tokens)
+}
+
+func (suite *LimitsTestSuite) TestBudgetLimitsTokens() {
+	budget := &Budget{MaxTokens: 25}
+	suite.True(budget.spend(10))
+	suite.False(budget.spend(20))
+	suite.True(budget.spend(15))
+
+	calls, tokens := budget.Spent()
+	suite.Equal(int64(2), calls)
+	suite.Equal(int64(25), tokens)
+}
+
+func (suite *LimitsTestSuite) TestEstimateTokensGrowsWithSamples() {
+	candidate := ContextCandidate{Mask: LogMask("Y Y"), Samples: []LogLine{LogLine("I started")}}
+	single := estimateTokens(candidate)
+
+	candidate.Samples = append(candidate.Samples, LogLine("I stopped after a very long while"))
+	suite.Greater(estimateTokens(candidate), single)
+}
+
+func TestLimitsTestSuite(t *testing.T) {
+	suite.Run(t, new(LimitsTestSuite))
+}
@@ -4,8 +4,10 @@ import (
 	//"flag"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"runtime"
 	"runtime/pprof"
 	"sync"
@@ -20,21 +22,117 @@ type Token []rune // Represents a single unit of value in a single line of log (
 type TokenLabel string
 
 type ContextCandidate struct {
-	Mask    LogMask
-	Samples []LogLine // 5-6 lines of logs with the same mask
+	Mask     LogMask
+	Samples  []LogLine // 5-6 lines of logs with the same mask
+	Known    []string  // Labels of the mask extracted without the contextualiser, empty where one is needed
+	Feedback string    // Why the previous answer for the candidate was rejected, empty on the first prompt
 }
 
 type Sentence struct {
-	Tokens []Token
-	Mask   LogMask
-	Line   LogLine
+	Tokens      []Token
+	Spans       []Span // Offsets of each token in Line, one per placeholder in Mask
+	Mask        LogMask
+	Line        LogLine
+	Fingerprint Fingerprint  // Registry key of Mask, computed once by the consumer
+	TemplateID  string       // Set by consumers that assign their own template identifiers
+	Repetitions []Repetition // Folded list units in Mask, in order of appearance
+	Fields      []Field      // Values parsed from embedded JSON and logfmt segments, when enabled
+	Priority    bool         // Set by admin priority rules, the mask is contextualised on its first line
 }
 
 var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to `file`")
 var memprofile = flag.String("memprofile", "", "write memory profile to `file`")
+var consumerName = flag.String("consumer", "mask", "template `miner` used to group lines: mask or drain")
+var drainDepth = flag.Int("drain-depth", defaultDrainDepth, "parse tree depth of the drain consumer")
+var drainSimilarity = flag.Float64("drain-similarity", defaultDrainSimilarity, "similarity threshold of the drain consumer")
+var drainReport = flag.String("drain-report", "", "write the templates of the drain consumer with their line counts to `file`, compare with -mask-report of a mask run")
+var foldRepetitions = flag.Bool("fold-repetitions", false, "fold repeated list units so variable-length lists share a mask")
+var maskWorkers = flag.Int("mask-workers", 1, "number of goroutines masking lines")
+var structuredFields = flag.Bool("structured-fields", false, "parse embedded JSON objects and logfmt tails into labelled fields")
+var unordered = flag.Bool("unordered", false, "emit masked lines as soon as they are ready instead of in input order")
+var clusterThreshold = flag.Int("cluster-threshold", 0, "maximum mask edit `distance` treated as a near-duplicate, 0 disables clustering")
+var clusterMerge = flag.Bool("cluster-merge", false, "merge near-duplicate masks automatically instead of only proposing them")
+var labelledFile = flag.String("labelled", "", "write labelled lines to `file` as JSON lines")
+var maskReport = flag.String("mask-report", "", "write the state, line count, first and last seen time and failure of every mask to `file`")
+var rulesFile = flag.String("rules", "", "route lines with the drop, quarantine and priority rules in `file`")
+var quarantineFile = flag.String("quarantine", "", "write lines quarantined by rules to `file`")
+var fallbackFile = flag.String("fallback", "./data/results/fallback.log", "write the lines of failed masks unlabelled to `file`, empty only counts them")
+var backlogLimit = flag.Int("backlog-limit", 0, "maximum pending `sentences` held in memory before spilling to disk, 0 is unbounded")
+var spillDir = flag.String("spill-dir", "./data/spill", "`directory` of the on-disk queue segments of spilled sentences, cleared at startup")
+var labelShards = flag.Int("label-shards", 1, "number of labeller shards, masks are pinned to a shard by fingerprint")
+var contextualiseAttempts = flag.Int("contextualise-attempts", defaultRetryPolicy.Attempts, "provider calls per mask before it is marked failed")
+var contextualiseWorkers = flag.Int("contextualise-workers", defaultCallWorkers, "masks contextualised at once")
+var contextualiseRate = flag.Float64("contextualise-rate", 0, "provider `calls` per second, 0 is unlimited")
+var contextualiseMaxCalls = flag.Int64("contextualise-max-calls", 0, "provider calls per run before new masks take the fallback path, 0 is unlimited")
+var contextualiseMaxTokens = flag.Int64("contextualise-max-tokens", 0, "estimated prompt tokens per run before new masks take the fallback path, 0 is unlimited")
+var contextCache = flag.String("context-cache", "", "keep the contexts of masks in `file` across runs, masks found there are registered at startup")
+var providerName = flag.String("provider", "braintrust", "context `provider` labelling masks: braintrust, openai or heuristic")
+var openAIEndpoint = flag.String("openai-endpoint", "http://localhost:8080/v1", "base `URL` of the OpenAI compatible API of the openai provider")
+var openAIModel = flag.String("openai-model", "", "`model` requested from the openai provider, servers of a single model ignore it")
+var heuristicFallback = flag.Bool("heuristic-fallback", false, "label masks with the heuristic provider when the provider fails or the budget is spent")
+var sampleThreshold = flag.Int("sample-threshold", defaultSamplePolicy.Threshold, "`lines` of a mask before it is contextualised")
+var sampleWait = flag.Duration("sample-wait", 0, "contextualise masks first seen this long ago with fewer lines than the threshold, and the rest at the end of the input, 0 waits for the threshold")
+var sampleFlush = flag.Bool("sample-flush", false, "contextualise masks with fewer lines than the threshold at the end of the input instead of writing their lines unlabelled to -fallback")
+var sampleReservoir = flag.Int("sample-reservoir", defaultSamplePolicy.Reservoir, "`lines` kept per mask to select diverse samples from")
+var promptSamples = flag.Int("prompt-samples", defaultSamplePolicy.Samples, "sample `lines` sent to the provider per mask")
+var registryFile = flag.String("registry", "", "load the mask registry from `file` at startup and save it back on exit")
+
+// Commands run instead of the pipeline when named as the first argument
+var commands = map[string]func(args []string, out io.Writer) error{
+	"migrate":    runMigrate,
+	"compress":   runCompress,
+	"decompress": runDecompress,
+	"search":     runSearch,
+}
+
+func NewConsumer(name string) (Consumer, error) {
+	switch name {
+	case "mask":
+		opts := []MaskConsumerOption{WithWorkers(*maskWorkers)}
+		if *unordered {
+			opts = append(opts, WithUnordered())
+		}
+
+		if *foldRepetitions {
+			opts = append(opts, WithRepetitionFolding())
+		}
+
+		if *structuredFields {
+			opts = append(opts, WithStructuredFields())
+		}
+
+		return NewMaskConsumer(opts...), nil
+	case "drain":
+		return NewDrainConsumer(*drainDepth, *drainSimilarity, defaultDrainMaxChildren), nil
+	default:
+		return nil, fmt.Errorf("unknown consumer %q", name)
+	}
+}
+
+func NewProvider(name string) (ContextProvider, error) {
+	switch name {
+	case "braintrust":
+		return NewBraintrustProvider(), nil
+	case "openai":
+		return NewOpenAIProvider(*openAIEndpoint, *openAIModel, os.Getenv("OPENAI_API_KEY")), nil
+	case "heuristic":
+		return NewHeuristicProvider(), nil
+	default:
+		return nil, fmt.Errorf("unknown provider %q", name)
+	}
+}
 
 func main() {
 	flag.Parse()
+	if command, exists := commands[flag.Arg(0)]; exists {
+		if err := command(flag.Args()[1:], os.Stdout); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
 		if err != nil {
@@ -55,13 +153,123 @@ func main() {
 	wg.Add(2)
 
 	fileReader := NewFileReader("./data/raw/mini.log")
-	maskConsumer := NewMaskConsumer()
+	consumer, err := NewConsumer(*consumerName)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	provider, err := NewProvider(*providerName)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	if *labelShards < 1 {
+		fmt.Println("label-shards must be at least 1")
+		return
+	}
+
 	_ = NewFileBufferWriter("./data/results/data.log", &wg)
 	_ = NewFileIntWriter("./data/results/data_int.log", &wg)
-	maskRegistry := NewMemoryStore()
+	maskRegistry := NewMaskStatusStore()
 	contextRegistry := NewContextStore()
-	admin := NewAdmin(maskRegistry, contextRegistry, &wg)
-	contextualiser := NewSentenceContextualiser(contextRegistry, maskRegistry, &wg)
+	templateRegistry := NewTemplateStore()
+	if *contextCache != "" {
+		cache, err := OpenFileStore[Context](*contextCache)
+		if err != nil {
+			fmt.Println("error when opening context cache:", err)
+			return
+		}
+
+		defer func() {
+			if err := cache.Close(); err != nil {
+				fmt.Println("error when closing context cache:", err)
+			}
+		}()
+
+		if stale := cache.Stale(); stale > 0 {
+			fmt.Printf("skipped %d cached contexts from another mask version\n", stale)
+		}
+
+		// Masks with a cached context are labelled straight away, and join registry snapshots and
+		// clustering like masks registered during the run
+		contextRegistry = cache.MemoryStore
+		var unknown int
+		for _, key := range contextRegistry.Keys() {
+			registerMask(maskRegistry, key)
+
+			context, _ := contextRegistry.Get(key)
+			if context.mask == nil {
+				unknown++
+				continue
+			}
+
+			templateRegistry.Put(key, context.mask)
+		}
+
+		if unknown > 0 {
+			fmt.Printf("%d cached contexts were written without their mask and are left out of registry snapshots\n", unknown)
+		}
+	}
+
+	sampleLines := NewSampleLineStore()
+	if *registryFile != "" {
+		entries, err := LoadRegistry(*registryFile)
+		if err != nil {
+			fmt.Println("error when loading registry:", err)
+			return
+		}
+
+		if stale := RestoreRegistry(entries, templateRegistry, maskRegistry, contextRegistry, sampleLines); stale > 0 {
+			fmt.Printf("skipped %d registry entries from another mask version, run migrate -in %s\n", stale, *registryFile)
+		}
+	}
+
+	var rules Rules
+	if *rulesFile != "" {
+		rules, err = LoadRules(*rulesFile)
+		if err != nil {
+			fmt.Println("error when loading rules:", err)
+			return
+		}
+	}
+
+	admin := NewAdmin(maskRegistry, contextRegistry, templateRegistry, sampleLines, rules, &wg)
+	var clusterer *MaskClusterer
+	if *clusterThreshold > 0 {
+		clusterer = NewMaskClusterer(*clusterThreshold)
+	}
+
+	retry := defaultRetryPolicy
+	retry.Attempts = *contextualiseAttempts
+	contextualiserOpts := []ContextualiserOption{
+		WithRetry(retry),
+		WithCallWorkers(*contextualiseWorkers),
+		WithRateLimit(*contextualiseRate),
+		WithBudget(*contextualiseMaxCalls, *contextualiseMaxTokens),
+		WithSamplePolicy(SamplePolicy{
+			Threshold: *sampleThreshold,
+			MaxWait:   *sampleWait,
+			Flush:     *sampleFlush,
+			Reservoir: *sampleReservoir,
+			Samples:   *promptSamples,
+		}),
+	}
+	if *heuristicFallback {
+		contextualiserOpts = append(contextualiserOpts, WithFallbackProvider(NewHeuristicProvider()))
+	}
+	if *backlogLimit > 0 {
+		spill, err := NewSpillQueue(*spillDir)
+		if err != nil {
+			fmt.Println("error when creating spill queue:", err)
+			return
+		}
+
+		contextualiserOpts = append(contextualiserOpts, WithBacklog(*backlogLimit, spill))
+	}
+
+	contextualiser := NewSentenceContextualiser(provider, contextRegistry, maskRegistry, templateRegistry, clusterer, *clusterMerge, &wg, contextualiserOpts...)
 	labeller := NewTokenLabeller(contextRegistry)
 
 	readOut, err := fileReader.Read()
@@ -70,37 +278,168 @@ func main() {
 		return
 	}
 
-	sentenceOut, err := maskConsumer.Consume(readOut)
+	sentenceOut, err := consumer.Consume(readOut)
 	if err != nil {
 		fmt.Println("error when masking")
 		return
 	}
 
-	unRegistered, registered, err := admin.Administrate(sentenceOut)
+	unRegistered, registered, fallback, quarantine, err := admin.Administrate(sentenceOut)
 	if err != nil {
 		fmt.Println("error when administrating")
 		return
 	}
 
-	err = contextualiser.Ingest(unRegistered, registered)
+	err = contextualiser.Ingest(unRegistered, registered, fallback)
 	if err != nil {
 		fmt.Println("error when contextualising")
 		return
 	}
 
-	_, err = labeller.Ingest(registered)
-	if err != nil {
-		fmt.Println("error when labelling")
-		return
+	var shardsLabelled []chan LabelledTokens
+	for _, shard := range admin.Shard(registered, *labelShards) {
+		shardLabelled, err := labeller.Ingest(shard)
+		if err != nil {
+			fmt.Println("error when labelling")
+			return
+		}
+
+		shardsLabelled = append(shardsLabelled, shardLabelled)
 	}
 
+	labelled := MergeLabelled(shardsLabelled...)
+
 	go func() {
 		// Synced between admin and contextualiser
-		// as both are channel writers to registered chan
+		// as both are channel writers to registered and fallback chans
 		wg.Wait()
 		close(registered)
+		close(fallback)
+	}()
+
+	// Quarantined lines are kept out of the pipeline, optionally written aside as they came in
+	var quarantined sync.WaitGroup
+	quarantined.Add(1)
+	quarantineLines := make(chan []rune, 100)
+	if *quarantineFile != "" {
+		if err := NewFileBufferWriter(*quarantineFile, &quarantined).Write(quarantineLines); err != nil {
+			fmt.Println("error when writing quarantined lines")
+			return
+		}
+	} else {
+		go func() {
+			defer quarantined.Done()
+			for range quarantineLines {
+			}
+		}()
+	}
+
+	go func() {
+		defer close(quarantineLines)
+		for s := range quarantine {
+			quarantineLines <- s.Line
+		}
+	}()
+
+	// Lines of failed masks cannot be labelled, they are written aside as they are
+	var fallbackWritten sync.WaitGroup
+	fallbackWritten.Add(1)
+	fallbackLines := make(chan []rune, 100)
+	if *fallbackFile != "" {
+		if err := os.MkdirAll(filepath.Dir(*fallbackFile), 0o755); err != nil {
+			fmt.Println("error when creating fallback directory:", err)
+			return
+		}
+
+		if err := NewFileBufferWriter(*fallbackFile, &fallbackWritten).Write(fallbackLines); err != nil {
+			fmt.Println("error when writing fallback lines")
+			return
+		}
+	} else {
+		go func() {
+			defer fallbackWritten.Done()
+			for range fallbackLines {
+			}
+		}()
+	}
+
+	fallbackCount := make(chan int, 1)
+	go func() {
+		defer close(fallbackLines)
+
+		var count int
+		for s := range fallback {
+			fallbackLines <- s.Line
+			count++
+		}
+
+		fallbackCount <- count
 	}()
 
+	if *labelledFile != "" {
+		var writers sync.WaitGroup
+		writers.Add(1)
+		if err := NewLabelledJSONWriter(*labelledFile, &writers).Write(labelled); err != nil {
+			fmt.Println("error when writing labelled lines")
+			return
+		}
+
+		writers.Wait()
+	} else {
+		for range labelled {
+		}
+	}
+
+	fallbackWritten.Wait()
+	if count := <-fallbackCount; count > 0 && *fallbackFile != "" {
+		fmt.Printf("%d lines of failed masks were written unlabelled to %s\n", count, *fallbackFile)
+	} else if count > 0 {
+		fmt.Printf("%d lines of failed masks were not labelled\n", count)
+	}
+
+	quarantined.Wait()
+	if dropped := admin.Dropped(); dropped > 0 {
+		fmt.Printf("%d lines dropped by rules\n", dropped)
+	}
+
+	if calls, tokens := contextualiser.Spent(); calls > 0 {
+		fmt.Printf("%d provider calls, about %d prompt tokens\n", calls, tokens)
+	}
+
+	PrintMaskStates(maskRegistry, os.Stdout)
+	if *maskReport != "" {
+		if err := maskRegistry.Report(*maskReport); err != nil {
+			fmt.Println("error when writing mask report:", err)
+		}
+	}
+
+	if drain, ok := consumer.(*DrainConsumer); ok && *drainReport != "" {
+		if err := drain.Report(*drainReport); err != nil {
+			fmt.Println("error when writing drain report:", err)
+		}
+	}
+
+	// Masks registered during the run may be near-duplicates of each other, which the check of new
+	// masks against contextualised ones could not see when they were first seen
+	if clusterer != nil {
+		proposals := clusterer.ProposeRegistry(templateRegistry, contextRegistry)
+		PrintProposals(proposals, os.Stdout)
+		if *clusterMerge {
+			for _, p := range proposals {
+				if err := clusterer.Merge(p, maskRegistry, contextRegistry); err != nil {
+					fmt.Printf("could not merge near-duplicates of %s: %v\n", FingerprintOf(p.Canonical), err)
+				}
+			}
+		}
+	}
+
+	if *registryFile != "" {
+		entries := SnapshotRegistry(templateRegistry, maskRegistry, contextRegistry, sampleLines)
+		if err := SaveRegistry(*registryFile, entries); err != nil {
+			fmt.Println("error when saving registry:", err)
+		}
+	}
+
 	if *memprofile != "" {
 		f, err := os.Create(*memprofile)
 		if err != nil {
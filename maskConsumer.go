@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"sync"
 )
 
 const (
@@ -22,15 +23,22 @@ type Consumer interface {
 	Consume(chan []rune) (chan Sentence, error)
 }
 
+// Compress keeps one Y per run of Ys in a new mask, leaving input untouched. rawInput is not used.
 func Compress(input []rune, rawInput []rune) (LogMask, error) {
-	var counter int
 	content := make([]rune, len(input))
 	copy(content, input)
 
+	return compressInPlace(content), nil
+}
+
+// compressInPlace is Compress reusing the backing array of input, for scratch buffers of the caller
+func compressInPlace(input []rune) LogMask {
+	var counter int
+
 	for i, current := range input {
 		// Append all symbols
 		if current != topLevelAlphaNumericContent {
-			content[counter] = current
+			input[counter] = current
 			counter++
 			continue
 		}
@@ -38,94 +46,359 @@ func Compress(input []rune, rawInput []rune) (LogMask, error) {
 		// Only append the last Y of connected Ys
 		// Only append the last Y of the input
 		if (i+1) == len(input) || input[i+1] != topLevelAlphaNumericContent {
-			content[counter] = current
+			input[counter] = current
 			counter++
 		}
 	}
 
-	return content[:counter], nil
+	return input[:counter]
 }
 
-func Maskify(input []rune, closingSym rune) ([]rune, int, []Token, error) {
-	var content []rune
-	var compressedContent []Token
-	var compressedContentCounter int
+// Span locates a token in its line, End is exclusive
+type Span struct {
+	Start int
+	End   int
+}
+
+func isAlphaNumeric(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')
+}
+
+// closingSymbols are the distinct closing symbols of enclosingSymbols, one column each in
+// maskScratch.next
+var closingSymbols = [...]rune{']', '}', '>', ')', '"', '\''}
+
+func closingColumn(r rune) int {
+	switch r {
+	case ']':
+		return 0
+	case '}':
+		return 1
+	case '>':
+		return 2
+	case ')':
+		return 3
+	case '"':
+		return 4
+	case '\'':
+		return 5
+	default:
+		return -1
+	}
+}
+
+// openingColumn is the column of the closing symbol of an opening symbol, -1 for other runes
+func openingColumn(r rune) int {
+	switch r {
+	case '[':
+		return 0
+	case '{':
+		return 1
+	case '<':
+		return 2
+	case '(':
+		return 3
+	case '"':
+		return 4
+	case '\'':
+		return 5
+	default:
+		return -1
+	}
+}
+
+// maskScratch holds the buffers reused from line to line by a single masking goroutine,
+// so masking does not allocate once the buffers have grown to the longest line
+type maskScratch struct {
+	content []rune
+	spans   []Span
+	next    []int32 // Row i holds where the search for each closing symbol from input[from+i] ends, see index
+	from    int
+}
+
+func newMaskScratch() *maskScratch {
+	return &maskScratch{
+		content: make([]rune, 0, 256),
+		spans:   make([]Span, 0, 32),
+	}
+}
+
+// index finds, for every position of input from from onwards and every closing symbol, the index
+// of the symbol findClosing stops at when searching from that position, len(input) when there is
+// none. Searching skips enclosures that are closed as a whole and treats unclosed opening symbols
+// as plain symbols. Whether an enclosure closes only depends on the input after it, so a single
+// pass from the end of the line resolves every search, in time linear in the line however many
+// enclosures are left open.
+func (ms *maskScratch) index(input []rune, from int) {
+	width := len(closingSymbols)
+	n := len(input)
+	ms.from = from
+	// Grown by hand, appending a made slice allocates under the race detector
+	size := (n - from + 1) * width
+	if cap(ms.next) < size {
+		ms.next = make([]int32, size)
+	}
+	ms.next = ms.next[:size]
+	clear(ms.next)
+
+	last := ms.next[(n-from)*width:]
+	for c := range last {
+		last[c] = int32(n)
+	}
+
+	for i := n - 1; i >= from; i-- {
+		// A search reaching an enclosure that closes continues after its closing symbol
+		after := i + 1
+		if c := openingColumn(input[i]); c >= 0 {
+			if end := int(ms.next[(i+1-from)*width+c]); end < n {
+				after = end + 1
+			}
+		}
+
+		row := ms.next[(i-from)*width : (i-from+1)*width]
+		copy(row, ms.next[(after-from)*width:(after-from+1)*width])
+
+		// Closing symbols are checked first because some of them are the same as their opening
+		if c := closingColumn(input[i]); c >= 0 {
+			row[c] = int32(i)
+		}
+	}
+}
+
+// findClosing returns the index of closingSym in input from i onwards, using the index of input,
+// which must cover i.
+// Enclosures opened on the way are skipped as a whole when they are closed, and treated as plain
+// symbols when they are not.
+func (ms *maskScratch) findClosing(input []rune, i int, closingSym rune) (int, bool) {
+	column := closingColumn(closingSym)
+	if column < 0 {
+		return len(input), false
+	}
+
+	end := int(ms.next[(i-ms.from)*len(closingSymbols)+column])
+	return end, end < len(input)
+}
+
+// maskify masks a whole line and locates the token behind every placeholder. Every run of
+// alphanumerics becomes a run of Ys and every closed enclosure becomes a single X, each with
+// exactly one span, so the compressed mask has as many placeholders as there are spans.
+// Unclosed opening symbols are kept as plain symbols and their content is masked as top level.
+func (ms *maskScratch) maskify(input []rune) {
+	ms.content = ms.content[:0]
+	ms.spans = ms.spans[:0]
+	indexed := false
+	run := -1
 
 	for i := 0; i < len(input); i++ {
 		r := input[i]
-		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
-			content = append(content, topLevelAlphaNumericContent)
-			compressedContentCounter++
-		} else {
-			content = append(content, input[i])
-			if compressedContentCounter > 0 {
-				compressedContent = append(compressedContent, input[i-compressedContentCounter:i])
+		if isAlphaNumeric(r) {
+			ms.content = append(ms.content, topLevelAlphaNumericContent)
+			if run < 0 {
+				run = i
 			}
 
-			compressedContentCounter = 0
+			continue
 		}
 
-		closing, opening := enclosingSymbols[input[i]]
+		if run >= 0 {
+			ms.spans = append(ms.spans, Span{Start: run, End: i})
+			run = -1
+		}
+
+		ms.content = append(ms.content, r)
 
-		// Check for closing syms first because some closing symbols can be the same as their opening
-		if input[i] == closingSym {
-			// Closing Sym found, all nested content in this stack should be masked
-			return []rune{nestedContent, closingSym}, i, compressedContent, nil
+		closing, opening := enclosingSymbols[r]
+		if !opening {
+			continue
 		}
 
-		if opening {
-			// State A: Closing sym found -> Mask returned
-			// State B: Closing sym found but no content wanted -> empty rune slice returned
-			innerContent, depth, _, err := Maskify(input[i+1:], closing)
-			if err != nil {
-				return []rune{}, 0, []Token{}, err
-			}
+		// Lines are only indexed from their first opening symbol, the searches start after it
+		if !indexed {
+			ms.index(input, i)
+			indexed = true
+		}
 
-			// Add raw content that will be compressed
-			compressedContent = append(compressedContent, input[i+1:i+depth+1])
-			// Fast forward + offset
-			i = i + depth + 1
+		// Closing Sym found, all nested content should be masked
+		if end, found := ms.findClosing(input, i+1, closing); found {
+			ms.content = append(ms.content, nestedContent, closing)
+			ms.spans = append(ms.spans, Span{Start: i + 1, End: end})
+			// Fast forward to the closing sym
+			i = end
+		}
+	}
 
-			// Append whatever Mask returns
-			content = append(content, innerContent...)
-			if i >= len(input) {
-				break
-			}
+	// A run reaching the end of the line is a token like any other
+	if run >= 0 {
+		ms.spans = append(ms.spans, Span{Start: run, End: len(input)})
+	}
+}
 
-			continue
+func spanTokens(input []rune, spans []Span) []Token {
+	tokens := make([]Token, len(spans))
+	for i, span := range spans {
+		tokens[i] = input[span.Start:span.End]
+	}
+
+	return tokens
+}
+
+// Maskify masks input up to closingSym. A closingSym of 0 masks the whole input as a top level line.
+// It returns the uncompressed mask, the amount of input processed and the tokens behind the placeholders.
+// Maskify uses fresh buffers on every call, hot paths should reuse a maskScratch instead.
+func Maskify(input []rune, closingSym rune) ([]rune, int, []Token, error) {
+	scratch := newMaskScratch()
+	if closingSym != 0 {
+		scratch.index(input, 0)
+		if end, found := scratch.findClosing(input, 0, closingSym); found {
+			return []rune{nestedContent, closingSym}, end, []Token{input[:end]}, nil
+		}
+	}
+
+	// No closing symbols found, mask whatever we have as top level content.
+	scratch.maskify(input)
+	return scratch.content, len(input), spanTokens(input, scratch.spans), nil
+}
+
+// CheckAlignment verifies that every placeholder of the mask maps to exactly one token and that
+// every token is the slice of the line its span points at
+func CheckAlignment(s Sentence) error {
+	placeholders := countPlaceholders(ExpandRepetitions(s.Mask, s.Repetitions))
+	if placeholders != len(s.Tokens) || len(s.Tokens) != len(s.Spans) {
+		return fmt.Errorf(
+			"mask/token misalignment: %d placeholders, %d tokens, %d spans",
+			placeholders,
+			len(s.Tokens),
+			len(s.Spans),
+		)
+	}
+
+	previous := 0
+	for i, span := range s.Spans {
+		if span.Start < previous || span.End < span.Start || span.End > len(s.Line) {
+			return fmt.Errorf("token %d has invalid span [%d, %d)", i, span.Start, span.End)
 		}
+
+		if !equalRunes(s.Line[span.Start:span.End], s.Tokens[i]) {
+			return fmt.Errorf("token %d does not match its span [%d, %d)", i, span.Start, span.End)
+		}
+
+		previous = span.End
+	}
+
+	return nil
+}
+
+// Bounds how far the output can lag behind the slowest worker, and with it the reorder buffer
+const reorderWindow = 1024
+
+// MaskConsumer is not safe for concurrent calls to Mask, parallel workers in Consume own their scratch
+type MaskConsumer struct {
+	scratch         *maskScratch
+	foldRepetitions bool
+	parseFields     bool
+	workers         int
+	unordered       bool
+}
+
+type MaskConsumerOption func(*MaskConsumer)
+
+// WithRepetitionFolding folds repeated list units in masks, see FoldRepetitions
+func WithRepetitionFolding() MaskConsumerOption {
+	return func(mc *MaskConsumer) {
+		mc.foldRepetitions = true
 	}
+}
 
-	// No closing symbols found, return whatever we have processed.
-	// Amount processed is not len(content)
-	return content, len(input), compressedContent, nil
+// WithStructuredFields parses embedded JSON objects and logfmt tails into fields, see ParseFields
+func WithStructuredFields() MaskConsumerOption {
+	return func(mc *MaskConsumer) {
+		mc.parseFields = true
+	}
 }
 
-type MaskConsumer struct{}
+// WithWorkers masks lines on n goroutines. Output keeps the input order unless WithUnordered is set.
+func WithWorkers(n int) MaskConsumerOption {
+	return func(mc *MaskConsumer) {
+		mc.workers = n
+	}
+}
+
+// WithUnordered emits sentences as soon as any worker finishes them
+func WithUnordered() MaskConsumerOption {
+	return func(mc *MaskConsumer) {
+		mc.unordered = true
+	}
+}
+
+func NewMaskConsumer(opts ...MaskConsumerOption) *MaskConsumer {
+	mc := &MaskConsumer{
+		scratch: newMaskScratch(),
+		workers: 1,
+	}
+	for _, opt := range opts {
+		opt(mc)
+	}
 
-func NewMaskConsumer() *MaskConsumer {
-	return &MaskConsumer{}
+	return mc
 }
 
 func (mc *MaskConsumer) Mask(input []rune) (Sentence, error) {
-	maskedSymbols, _, tokens, err := Maskify(input, 0)
-	if err != nil {
+	var sentence Sentence
+	if err := mc.MaskInto(input, &sentence); err != nil {
 		return Sentence{}, err
 	}
 
-	compressed, err := Compress(maskedSymbols, input)
-	if err != nil {
-		return Sentence{}, err
+	return sentence, nil
+}
+
+// MaskInto masks input into s, reusing the slices s already holds. Masking a line into a
+// reused Sentence does not allocate unless repetition folding or structured fields are enabled.
+func (mc *MaskConsumer) MaskInto(input []rune, s *Sentence) error {
+	return mc.maskWith(mc.scratch, input, s)
+}
+
+func (mc *MaskConsumer) maskWith(scratch *maskScratch, input []rune, s *Sentence) error {
+	scratch.maskify(input)
+
+	compressed := compressInPlace(scratch.content)
+
+	var repetitions []Repetition
+	if mc.foldRepetitions {
+		compressed, repetitions = FoldRepetitions(compressed)
+	}
+
+	// A fresh Sentence gets exactly sized slices, a reused one keeps its capacity
+	if s.Mask == nil {
+		s.Tokens = make([]Token, 0, len(scratch.spans))
+		s.Spans = make([]Span, 0, len(scratch.spans))
+		s.Mask = make(LogMask, 0, len(compressed))
 	}
 
-	return Sentence{
-		Tokens: tokens,
-		Mask:   compressed,
-		Line:   input,
-	}, nil
+	*s = Sentence{
+		Tokens:      s.Tokens[:0],
+		Spans:       append(s.Spans[:0], scratch.spans...),
+		Mask:        append(s.Mask[:0], compressed...),
+		Line:        input,
+		Fingerprint: FingerprintOf(compressed),
+		Repetitions: repetitions,
+	}
+
+	for _, span := range scratch.spans {
+		s.Tokens = append(s.Tokens, input[span.Start:span.End])
+	}
+
+	if mc.parseFields {
+		s.Fields = ParseFields(*s)
+	}
+
+	return CheckAlignment(*s)
 }
 
 func (mc *MaskConsumer) Consume(in chan []rune) (chan Sentence, error) {
+	if mc.workers > 1 {
+		return mc.consumeParallel(in), nil
+	}
+
 	sentenceChan := make(chan Sentence, 100)
 
 	go func() {
@@ -143,3 +416,89 @@ func (mc *MaskConsumer) Consume(in chan []rune) (chan Sentence, error) {
 
 	return sentenceChan, nil
 }
+
+type sequencedLine struct {
+	seq  int
+	line []rune
+}
+
+type sequencedSentence struct {
+	seq      int
+	sentence Sentence
+}
+
+// consumeParallel numbers every line, masks them on a pool of workers and, unless unordered,
+// restores the input order with a reorder buffer before emitting
+func (mc *MaskConsumer) consumeParallel(in chan []rune) chan Sentence {
+	sentenceChan := make(chan Sentence, 100)
+	jobs := make(chan sequencedLine, 100)
+	results := make(chan sequencedSentence, 100)
+
+	// Every line in flight holds a slot until it is emitted
+	slots := make(chan struct{}, reorderWindow)
+
+	go func() {
+		defer close(jobs)
+
+		var seq int
+		for log := range in {
+			slots <- struct{}{}
+			jobs <- sequencedLine{seq: seq, line: log}
+			seq++
+		}
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(mc.workers)
+	for i := 0; i < mc.workers; i++ {
+		go func() {
+			defer wg.Done()
+
+			scratch := newMaskScratch()
+			for job := range jobs {
+				var sentence Sentence
+				err := mc.maskWith(scratch, job.line, &sentence)
+				if err != nil {
+					fmt.Println("consumer error with masking")
+				}
+
+				results <- sequencedSentence{seq: job.seq, sentence: sentence}
+			}
+		}()
+	}
+
+	go func() {
+		// Safe to close results once every worker has stopped writing
+		wg.Wait()
+		close(results)
+	}()
+
+	go func() {
+		defer close(sentenceChan)
+
+		pending := make(map[int]Sentence)
+		var next int
+		for r := range results {
+			if mc.unordered {
+				sentenceChan <- r.sentence
+				<-slots
+				continue
+			}
+
+			pending[r.seq] = r.sentence
+			for {
+				sentence, ready := pending[next]
+				if !ready {
+					break
+				}
+
+				delete(pending, next)
+				sentenceChan <- sentence
+				<-slots
+				next++
+			}
+		}
+	}()
+
+	return sentenceChan
+}
@@ -1,7 +1,16 @@
 package main
 
 import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"os"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
 	"testing"
+	"testing/quick"
 
 	"github.com/stretchr/testify/suite"
 )
@@ -25,7 +34,8 @@ func (suite *MaskConsumerTestSuite) TestMaskifyBasicAlphanumeric() {
 	suite.NoError(err)
 	suite.Equal([]rune("YYYYYYYY"), result)
 	suite.Equal(len(input), depth)
-	suite.Len(tokens, 0) // No tokens because no separators
+	suite.Len(tokens, 1) // The whole run is a single token
+	suite.Equal([]rune("hello123"), []rune(tokens[0]))
 }
 
 func (suite *MaskConsumerTestSuite) TestMaskifyWithSymbols() {
@@ -36,9 +46,10 @@ func (suite *MaskConsumerTestSuite) TestMaskifyWithSymbols() {
 	expected := []rune("YYYYY-YYYYY_YYY")
 	suite.Equal(expected, result)
 	suite.Equal(len(input), depth)
-	suite.Len(tokens, 2) // Only "hello", "world" (final token not captured)
+	suite.Len(tokens, 3) // "hello", "world" and the final "123"
 	suite.Equal([]rune("hello"), []rune(tokens[0]))
 	suite.Equal([]rune("world"), []rune(tokens[1]))
+	suite.Equal([]rune("123"), []rune(tokens[2]))
 }
 
 func (suite *MaskConsumerTestSuite) TestMaskifyWithNestedBrackets() {
@@ -49,9 +60,10 @@ func (suite *MaskConsumerTestSuite) TestMaskifyWithNestedBrackets() {
 	expected := []rune("YYYY[X]YYYYYYY")
 	suite.Equal(expected, result)
 	suite.Equal(len(input), depth)
-	suite.Len(tokens, 2) // "test" and "nested" (content not captured)
+	suite.Len(tokens, 3) // "test", "nested" and the final "content"
 	suite.Equal([]rune("test"), []rune(tokens[0]))
 	suite.Equal([]rune("nested"), []rune(tokens[1]))
+	suite.Equal([]rune("content"), []rune(tokens[2]))
 }
 
 func (suite *MaskConsumerTestSuite) TestMaskifyWithNestedQuotes() {
@@ -78,6 +90,15 @@ func (suite *MaskConsumerTestSuite) TestCompressConsecutiveYs() {
 	suite.Equal(expected, result)
 }
 
+func (suite *MaskConsumerTestSuite) TestCompressLeavesInputUntouched() {
+	input := []rune("YYYY-YY")
+
+	_, err := Compress(input, []rune("abcd-ef"))
+
+	suite.NoError(err)
+	suite.Equal("YYYY-YY", string(input))
+}
+
 func (suite *MaskConsumerTestSuite) TestCompressWithNoConsecutiveYs() {
 	input := []rune("Y-Y-Y")
 	original := []rune("a-b-c")
@@ -145,6 +166,57 @@ func (suite *MaskConsumerTestSuite) TestConsumeChannel() {
 	}
 }
 
+func (suite *MaskConsumerTestSuite) TestConsumeParallelPreservesOrder() {
+	consumer := NewMaskConsumer(WithWorkers(4))
+	input := make(chan []rune, 100)
+
+	go func() {
+		defer close(input)
+		for i := 0; i < 5000; i++ {
+			input <- []rune(fmt.Sprintf("line %d key=%d", i, i))
+		}
+	}()
+
+	output, err := consumer.Consume(input)
+	suite.NoError(err)
+
+	var i int
+	for sentence := range output {
+		suite.Equal(fmt.Sprintf("line %d key=%d", i, i), string(sentence.Line))
+		i++
+	}
+	suite.Equal(5000, i)
+}
+
+func (suite *MaskConsumerTestSuite) TestConsumeParallelUnordered() {
+	consumer := NewMaskConsumer(WithWorkers(4), WithUnordered())
+	input := make(chan []rune, 100)
+
+	go func() {
+		defer close(input)
+		for i := 0; i < 5000; i++ {
+			input <- []rune(fmt.Sprintf("line %d", i))
+		}
+	}()
+
+	output, err := consumer.Consume(input)
+	suite.NoError(err)
+
+	var lines []string
+	for sentence := range output {
+		lines = append(lines, string(sentence.Line))
+	}
+
+	// Every line arrives exactly once, in whatever order
+	expected := make([]string, 5000)
+	for i := range expected {
+		expected[i] = fmt.Sprintf("line %d", i)
+	}
+	sort.Strings(expected)
+	sort.Strings(lines)
+	suite.Equal(expected, lines)
+}
+
 // Table-driven tests for various log formats
 func (suite *MaskConsumerTestSuite) TestMaskVariousLogFormats() {
 	testCases := []struct {
@@ -227,6 +299,176 @@ func (suite *MaskConsumerTestSuite) TestMaskifyUnmatchedBrackets() {
 	}
 }
 
+func (suite *MaskConsumerTestSuite) TestMaskAlignsTokensWithPlaceholders() {
+	testCases := []struct {
+		name   string
+		input  string
+		mask   string
+		tokens []string
+	}{
+		{"trailing run", "pid=1702", "Y=Y", []string{"pid", "1702"}},
+		{"empty enclosure", `tag=""`, `Y="X"`, []string{"tag", ""}},
+		{"unclosed bracket", "test[a-b", "Y[Y-Y", []string{"test", "a", "b"}},
+		{"unclosed inside enclosure", `a[b"c]`, "Y[X]", []string{"a", `b"c`}},
+		{"nested enclosures", "outer[inner{deep}]end", "Y[X]Y", []string{"outer", "inner{deep}", "end"}},
+	}
+
+	for _, tc := range testCases {
+		suite.Run(tc.name, func() {
+			sentence, err := suite.consumer.Mask([]rune(tc.input))
+			suite.NoError(err)
+
+			suite.Equal(tc.mask, string(sentence.Mask))
+			var tokens []string
+			for _, token := range sentence.Tokens {
+				tokens = append(tokens, string(token))
+			}
+			suite.Equal(tc.tokens, tokens)
+			suite.NoError(CheckAlignment(sentence))
+		})
+	}
+}
+
+func (suite *MaskConsumerTestSuite) TestMaskSpans() {
+	sentence, err := suite.consumer.Mask([]rune(`uid=1000, tag="*launch*"`))
+	suite.NoError(err)
+
+	suite.Equal([]Span{{0, 3}, {4, 8}, {10, 13}, {15, 23}}, sentence.Spans)
+}
+
+func (suite *MaskConsumerTestSuite) TestCheckAlignmentRejectsMismatch() {
+	sentence := suite.helper.CreateTestSentence("pid=1702", []string{"pid"}, "Y=Y")
+	sentence.Spans = []Span{{0, 3}}
+	suite.Error(CheckAlignment(sentence))
+
+	sentence = suite.helper.CreateTestSentence("pid=1702", []string{"pid", "1702"}, "Y=Y")
+	sentence.Spans = []Span{{0, 3}, {4, 7}}
+	suite.Error(CheckAlignment(sentence))
+}
+
+func (suite *MaskConsumerTestSuite) TestTestdataAlignment() {
+	for _, name := range []string{"sample.log", "malformed.log", "empty.log"} {
+		file, err := os.Open(suite.helper.GetTestDataPath(name))
+		suite.Require().NoError(err)
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			sentence, err := suite.consumer.Mask([]rune(scanner.Text()))
+			suite.NoError(err, scanner.Text())
+			suite.NoError(CheckAlignment(sentence), scanner.Text())
+		}
+		file.Close()
+	}
+}
+
+func (suite *MaskConsumerTestSuite) TestMaskDeeplyNestedEnclosures() {
+	depth := 100000
+	input := []rune(strings.Repeat("[", depth) + "x" + strings.Repeat("]", depth))
+
+	sentence, err := suite.consumer.Mask(input)
+
+	suite.NoError(err)
+	suite.Equal("[X]", string(sentence.Mask))
+	suite.Len(sentence.Tokens, 1)
+}
+
+func (suite *MaskConsumerTestSuite) TestMaskManyUnclosedEnclosures() {
+	// Each unclosed opening symbol used to double the masking time
+	for _, opening := range []string{"[", "<", "(", "[(<{"} {
+		input := []rune("start " + strings.Repeat(opening, 1000) + " end")
+
+		sentence, err := suite.consumer.Mask(input)
+
+		suite.NoError(err)
+		suite.Equal(string(input), string(sentence.Line))
+		suite.Equal("Y "+strings.Repeat(opening, 1000)+" Y", string(sentence.Mask))
+		suite.NoError(CheckAlignment(sentence))
+	}
+
+	// Unclosed openings still leave the enclosures after them intact
+	sentence, err := suite.consumer.Mask([]rune(strings.Repeat("(", 1000) + "[a b]"))
+	suite.NoError(err)
+	suite.Equal(strings.Repeat("(", 1000)+"[X]", string(sentence.Mask))
+}
+
+func (suite *MaskConsumerTestSuite) TestMaskIntoReusesSentence() {
+	var sentence Sentence
+	suite.NoError(suite.consumer.MaskInto([]rune("release:lock=189667585, flg=0x0"), &sentence))
+	suite.NoError(suite.consumer.MaskInto([]rune("pid=1702"), &sentence))
+
+	suite.Equal("Y=Y", string(sentence.Mask))
+	suite.Equal([]Token{Token("pid"), Token("1702")}, sentence.Tokens)
+	suite.Equal([]Span{{0, 3}, {4, 8}}, sentence.Spans)
+}
+
+func TestMaskingDoesNotAllocate(t *testing.T) {
+	input := []rune(`03-17 16:13:38.936  1702 14638 D PowerManagerService: release:lock=189667585, flg=0x0, tag="*launch*", name=android", ws=WorkSource{10113}, uid=1000, pid=1702`)
+
+	scratch := newMaskScratch()
+	scratch.maskify(input)
+	if allocs := testing.AllocsPerRun(100, func() { scratch.maskify(input) }); allocs != 0 {
+		t.Errorf("maskify allocated %v times per line", allocs)
+	}
+
+	buffer := make([]rune, len(scratch.content))
+	if allocs := testing.AllocsPerRun(100, func() {
+		copy(buffer, scratch.content)
+		_ = compressInPlace(buffer)
+	}); allocs != 0 {
+		t.Errorf("compressInPlace allocated %v times per line", allocs)
+	}
+
+	consumer := NewMaskConsumer()
+	var sentence Sentence
+	consumer.MaskInto(input, &sentence)
+	if allocs := testing.AllocsPerRun(100, func() { _ = consumer.MaskInto(input, &sentence) }); allocs != 0 {
+		t.Errorf("MaskInto allocated %v times per line", allocs)
+	}
+}
+
+// logLike generates strings made of the runes that drive masking, so enclosures and runs are frequent
+type logLike string
+
+func (logLike) Generate(r *rand.Rand, size int) reflect.Value {
+	alphabet := []rune("aZ09 =:,.-_\"'[](){}<>ñ🚀\x00")
+	line := make([]rune, r.Intn(size+1))
+	for i := range line {
+		line[i] = alphabet[r.Intn(len(alphabet))]
+	}
+
+	return reflect.ValueOf(logLike(line))
+}
+
+func TestMaskAlignmentProperty(t *testing.T) {
+	consumers := []*MaskConsumer{NewMaskConsumer(), NewMaskConsumer(WithRepetitionFolding())}
+	aligned := func(line logLike) bool {
+		for _, consumer := range consumers {
+			sentence, err := consumer.Mask([]rune(string(line)))
+			if err != nil || CheckAlignment(sentence) != nil {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	if err := quick.Check(aligned, &quick.Config{MaxCount: 5000}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMaskAlignmentPropertyArbitraryStrings(t *testing.T) {
+	consumer := NewMaskConsumer(WithRepetitionFolding())
+	aligned := func(line string) bool {
+		sentence, err := consumer.Mask([]rune(line))
+		return err == nil && CheckAlignment(sentence) == nil
+	}
+
+	if err := quick.Check(aligned, &quick.Config{MaxCount: 2000}); err != nil {
+		t.Error(err)
+	}
+}
+
 func TestMaskConsumerTestSuite(t *testing.T) {
 	suite.Run(t, new(MaskConsumerTestSuite))
 }
@@ -257,11 +499,70 @@ func BenchmarkMaskConsumerMask(b *testing.B) {
 	}
 }
 
+// BenchmarkMaskConsumerThroughput measures lines per second through Consume for 1..N workers
+func BenchmarkMaskConsumerThroughput(b *testing.B) {
+	helper := &TestHelper{}
+	file, err := os.Open(helper.GetTestDataPath("sample.log"))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	var lines [][]rune
+	var size int64
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, []rune(scanner.Text()))
+		size += int64(len(scanner.Bytes()))
+	}
+	file.Close()
+
+	for workers := 1; workers <= runtime.NumCPU(); workers *= 2 {
+		for _, ordered := range []bool{true, false} {
+			opts := []MaskConsumerOption{WithWorkers(workers)}
+			name := fmt.Sprintf("workers=%d/ordered", workers)
+			if !ordered {
+				opts = append(opts, WithUnordered())
+				name = fmt.Sprintf("workers=%d/unordered", workers)
+			}
+
+			b.Run(name, func(b *testing.B) {
+				consumer := NewMaskConsumer(opts...)
+				input := make(chan []rune, 100)
+				b.SetBytes(size / int64(len(lines)))
+
+				go func() {
+					defer close(input)
+					for i := 0; i < b.N; i++ {
+						input <- lines[i%len(lines)]
+					}
+				}()
+
+				output, _ := consumer.Consume(input)
+				for range output {
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkMaskConsumerMaskInto(b *testing.B) {
+	consumer := NewMaskConsumer()
+	input := []rune("03-17 16:13:38.936  1702 14638 D PowerManagerService: release:lock=189667585")
+	var sentence Sentence
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		_ = consumer.MaskInto(input, &sentence)
+	}
+}
+
 func BenchmarkCompress(b *testing.B) {
 	input := []rune("YYYYYYYY-YYYYYYYY_YYYYYYYY")
-	original := []rune("something-something_something")
+	// compressInPlace overwrites its input, so every iteration starts from a fresh copy
+	buffer := make([]rune, len(input))
 
 	for i := 0; i < b.N; i++ {
-		_, _ = Compress(input, original)
+		copy(buffer, input)
+		_ = compressInPlace(buffer)
 	}
 }
\ No newline at end of file
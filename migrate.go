@@ -0,0 +1,178 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+// MigrationChange records old template IDs whose samples moved to new template IDs
+type MigrationChange struct {
+	From []string
+	To   []string
+}
+
+type MigrationReport struct {
+	Migrated int               // Entries re-masked under the current version
+	Current  int               // Entries already on the current version
+	Splits   []MigrationChange // One old entry whose samples now produce several masks
+	Merges   []MigrationChange // Several old entries whose samples now produce the same mask
+	Orphaned []string          // Old entries without samples, which cannot be re-masked
+	Relabel  []string          // New entries whose labels could not all be carried over
+}
+
+// MigrateRegistry re-masks the samples of every stale entry with the consumer and carries labels
+// over to the new masks by aligning old and new masks. Entries of the current version are kept.
+func MigrateRegistry(entries []RegistryEntry, consumer *MaskConsumer) ([]RegistryEntry, MigrationReport) {
+	var report MigrationReport
+	migrated := make(map[string]*RegistryEntry)
+	sources := make(map[string][]string)
+	var order []string
+
+	target := func(templateID string, mask LogMask) *RegistryEntry {
+		entry, exists := migrated[templateID]
+		if !exists {
+			entry = &RegistryEntry{
+				MaskVersion: maskVersion,
+				TemplateID:  templateID,
+				Mask:        string(mask),
+			}
+			migrated[templateID] = entry
+			order = append(order, templateID)
+		}
+
+		return entry
+	}
+
+	for _, old := range entries {
+		// Literal templates are not masked, so they are current whatever version wrote them
+		if _, template := entryKey(old); old.MaskVersion == maskVersion || template {
+			report.Current++
+			entry := target(old.TemplateID, LogMask(old.Mask))
+			entry.Registered = entry.Registered || old.Registered
+			if entry.Labels == nil {
+				entry.Labels = old.Labels
+			}
+			entry.Samples = appendSamples(entry.Samples, old.Samples...)
+			sources[old.TemplateID] = append(sources[old.TemplateID], old.TemplateID)
+			continue
+		}
+
+		if len(old.Samples) == 0 {
+			report.Orphaned = append(report.Orphaned, old.TemplateID)
+			continue
+		}
+
+		report.Migrated++
+		var targets []string
+		for _, sample := range old.Samples {
+			sentence, err := consumer.Mask([]rune(sample))
+			if err != nil {
+				continue
+			}
+
+			templateID := sentence.Fingerprint.String()
+			entry := target(templateID, sentence.Mask)
+			entry.Samples = appendSamples(entry.Samples, sample)
+
+			if !slices.Contains(targets, templateID) {
+				targets = append(targets, templateID)
+				sources[templateID] = append(sources[templateID], old.TemplateID)
+			}
+
+			// The first entry to reach a new mask decides its labels
+			if entry.Labels == nil && old.Labels != nil {
+				entry.Labels = RemapLabels(LogMask(old.Mask), old.Labels, sentence.Mask)
+				entry.Registered = old.Registered && !slices.Contains(entry.Labels, unknownLabel)
+				if old.Registered && !entry.Registered {
+					report.Relabel = append(report.Relabel, templateID)
+				}
+			}
+		}
+
+		if len(targets) > 1 {
+			report.Splits = append(report.Splits, MigrationChange{From: []string{old.TemplateID}, To: targets})
+		}
+	}
+
+	results := make([]RegistryEntry, 0, len(order))
+	for _, templateID := range order {
+		if len(sources[templateID]) > 1 {
+			report.Merges = append(report.Merges, MigrationChange{From: sources[templateID], To: []string{templateID}})
+		}
+
+		results = append(results, *migrated[templateID])
+	}
+
+	return results, report
+}
+
+// appendSamples keeps up to keptSamples distinct sample lines
+func appendSamples(samples []string, lines ...string) []string {
+	for _, line := range lines {
+		if len(samples) >= keptSamples {
+			break
+		}
+
+		if !slices.Contains(samples, line) {
+			samples = append(samples, line)
+		}
+	}
+
+	return samples
+}
+
+func (r MigrationReport) Print(w io.Writer) {
+	fmt.Fprintf(w, "migrated %d entries to mask version %d, %d already current\n", r.Migrated, maskVersion, r.Current)
+	for _, c := range r.Splits {
+		fmt.Fprintf(w, "split %s -> %s\n", strings.Join(c.From, ", "), strings.Join(c.To, ", "))
+	}
+
+	for _, c := range r.Merges {
+		fmt.Fprintf(w, "merge %s -> %s\n", strings.Join(c.From, ", "), strings.Join(c.To, ", "))
+	}
+
+	for _, id := range r.Orphaned {
+		fmt.Fprintf(w, "orphaned %s (no samples to re-mask)\n", id)
+	}
+
+	for _, id := range r.Relabel {
+		fmt.Fprintf(w, "relabel %s (labels could not all be carried over)\n", id)
+	}
+}
+
+// runMigrate implements the migrate command
+func runMigrate(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	in := flags.String("in", "", "registry `file` to migrate")
+	to := flags.String("out", "", "registry `file` to write, defaults to overwriting -in")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *in == "" {
+		return fmt.Errorf("migrate: -in is required")
+	}
+
+	if *to == "" {
+		*to = *in
+	}
+
+	entries, err := LoadRegistry(*in)
+	if err != nil {
+		return err
+	}
+
+	// Re-mask with the same options the pipeline masks with
+	consumer, err := NewConsumer("mask")
+	if err != nil {
+		return err
+	}
+
+	migrated, report := MigrateRegistry(entries, consumer.(*MaskConsumer))
+	report.Print(out)
+
+	return SaveRegistry(*to, migrated)
+}
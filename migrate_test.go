@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// MigrateTestSuite provides test suite for registry migration
+type MigrateTestSuite struct {
+	suite.Suite
+	consumer *MaskConsumer
+}
+
+func (suite *MigrateTestSuite) SetupTest() {
+	suite.consumer = NewMaskConsumer()
+}
+
+// stale builds an entry as an older mask version would have written it
+func stale(templateID string, mask string, labels []string, samples ...string) RegistryEntry {
+	return RegistryEntry{
+		MaskVersion: maskVersion - 1,
+		TemplateID:  templateID,
+		Mask:        mask,
+		Registered:  labels != nil,
+		Labels:      labels,
+		Samples:     samples,
+	}
+}
+
+func (suite *MigrateTestSuite) TestCarriesLabelsToNewMask() {
+	entries := []RegistryEntry{stale("old", "Y:Y", []string{"key", "value"}, "pid=1702")}
+
+	migrated, report := MigrateRegistry(entries, suite.consumer)
+
+	suite.Equal(1, report.Migrated)
+	suite.Require().Len(migrated, 1)
+	suite.Equal(maskVersion, migrated[0].MaskVersion)
+	suite.Equal("Y=Y", migrated[0].Mask)
+	suite.Equal(FingerprintOf(LogMask("Y=Y")).String(), migrated[0].TemplateID)
+	suite.Equal([]string{"key", "value"}, migrated[0].Labels)
+	suite.True(migrated[0].Registered)
+}
+
+func (suite *MigrateTestSuite) TestMigratesFoldedMasks() {
+	// Units longer than maxUnitLength were folded before version 2
+	long := strings.Repeat("-", maxUnitLength)
+	entries := []RegistryEntry{
+		stale("list", "RY=Y, EY=Y", []string{"key", "value", "key", "value"}, "k1=v1, k2=v2, k3=v3"),
+		stale("long", "RY"+long+", EY"+long, []string{"item", "item"}, "a"+long+", b"+long+", c"+long),
+	}
+
+	migrated, report := MigrateRegistry(entries, NewMaskConsumer(WithRepetitionFolding()))
+
+	suite.Equal(2, report.Migrated)
+	suite.Require().Len(migrated, 2)
+	suite.Equal("RY=Y, EY=Y", migrated[0].Mask)
+	suite.Equal([]string{"key", "value", "key", "value"}, migrated[0].Labels)
+	suite.True(migrated[0].Registered)
+
+	suite.Equal("Y"+long+", Y"+long+", Y"+long, migrated[1].Mask)
+	suite.Equal(FingerprintOf(LogMask(migrated[1].Mask)).String(), migrated[1].TemplateID)
+	suite.Equal(maskVersion, migrated[1].MaskVersion)
+}
+
+func (suite *MigrateTestSuite) TestKeepsDrainTemplates() {
+	mask := "job <*> finished"
+	old := stale(TemplateFingerprint(mask).String(), mask, []string{"id"}, "job 7 finished")
+
+	migrated, report := MigrateRegistry([]RegistryEntry{old}, suite.consumer)
+
+	suite.Equal(1, report.Current)
+	suite.Require().Len(migrated, 1)
+	suite.Equal(mask, migrated[0].Mask)
+	suite.Equal(old.TemplateID, migrated[0].TemplateID)
+	suite.Equal(maskVersion, migrated[0].MaskVersion)
+	suite.Equal([]string{"id"}, migrated[0].Labels)
+}
+
+func (suite *MigrateTestSuite) TestReportsSplit() {
+	entries := []RegistryEntry{stale("old", "Y Y", nil, "pid=1702", "main [worker]")}
+
+	migrated, report := MigrateRegistry(entries, suite.consumer)
+
+	suite.Len(migrated, 2)
+	suite.Require().Len(report.Splits, 1)
+	suite.Equal([]string{"old"}, report.Splits[0].From)
+	suite.Len(report.Splits[0].To, 2)
+}
+
+func (suite *MigrateTestSuite) TestReportsMerge() {
+	entries := []RegistryEntry{
+		stale("first", "Y:Y", []string{"key", "value"}, "pid=1702"),
+		stale("second", "Y_Y", nil, "uid=1000"),
+	}
+
+	migrated, report := MigrateRegistry(entries, suite.consumer)
+
+	suite.Require().Len(migrated, 1)
+	suite.Equal([]string{"pid=1702", "uid=1000"}, migrated[0].Samples)
+	suite.Require().Len(report.Merges, 1)
+	suite.Equal([]string{"first", "second"}, report.Merges[0].From)
+}
+
+func (suite *MigrateTestSuite) TestUnmappedLabelsNeedRelabelling() {
+	entries := []RegistryEntry{stale("old", "Y Y=Y", []string{"level", "key", "value"}, "main [worker] pid=1702")}
+
+	migrated, report := MigrateRegistry(entries, suite.consumer)
+
+	suite.Require().Len(migrated, 1)
+	suite.Equal([]string{"level", unknownLabel, "key", "value"}, migrated[0].Labels)
+	suite.False(migrated[0].Registered)
+	suite.Equal([]string{migrated[0].TemplateID}, report.Relabel)
+}
+
+func (suite *MigrateTestSuite) TestOrphansEntriesWithoutSamples() {
+	entries := []RegistryEntry{
+		stale("old", "Y=Y", []string{"key", "value"}),
+		{MaskVersion: maskVersion, TemplateID: "current", Mask: "Y [X]"},
+	}
+
+	migrated, report := MigrateRegistry(entries, suite.consumer)
+
+	suite.Equal([]string{"old"}, report.Orphaned)
+	suite.Equal(1, report.Current)
+	suite.Require().Len(migrated, 1)
+	suite.Equal("current", migrated[0].TemplateID)
+}
+
+func (suite *MigrateTestSuite) TestRunMigrateRewritesRegistry() {
+	in := filepath.Join(suite.T().TempDir(), "registry.jsonl")
+	suite.NoError(SaveRegistry(in, []RegistryEntry{stale("old", "Y:Y", []string{"key", "value"}, "pid=1702")}))
+
+	var out bytes.Buffer
+	suite.NoError(runMigrate([]string{"-in", in}, &out))
+	suite.Contains(out.String(), "migrated 1 entries")
+
+	entries, err := LoadRegistry(in)
+	suite.NoError(err)
+	suite.Require().Len(entries, 1)
+	suite.Equal(maskVersion, entries[0].MaskVersion)
+
+	suite.Error(runMigrate(nil, &out))
+}
+
+func TestMigrateTestSuite(t *testing.T) {
+	suite.Run(t, new(MigrateTestSuite))
+}
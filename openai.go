@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// OpenAIProvider labels masks with any server exposing the OpenAI chat completions API, such as
+// llama.cpp or vLLM. The answer is constrained by a JSON schema to an object holding exactly one
+// label per placeholder.
+type OpenAIProvider struct {
+	endpoint string // Base URL of the API, chat completions are posted to endpoint + "/chat/completions"
+	model    string
+	apiKey   string // Optional, sent as a bearer token
+	client   *http.Client
+}
+
+const openAIInstructions = "You label the variable positions of log templates. In the template, every Y is an alphanumeric value and every X is the content of an enclosure. " +
+	"Answer with one short snake_case label per placeholder, in order, describing what the value is. " +
+	"Known labels were extracted from key=value pairs and must be kept as they are."
+
+func NewOpenAIProvider(endpoint string, model string, apiKey string) *OpenAIProvider {
+	return &OpenAIProvider{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		model:    model,
+		apiKey:   apiKey,
+		client:   &http.Client{Timeout: 2 * time.Minute},
+	}
+}
+
+type openAIMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type openAIRequest struct {
+	Model          string                 `json:"model,omitempty"`
+	Messages       []openAIMessage        `json:"messages"`
+	Temperature    float64                `json:"temperature"`
+	ResponseFormat map[string]interface{} `json:"response_format"`
+}
+
+type openAIResponse struct {
+	Choices []struct {
+		Message openAIMessage `json:"message"`
+	} `json:"choices"`
+}
+
+// labelsSchema constrains an answer to {"labels": [...]} with count labels
+func labelsSchema(count int) map[string]interface{} {
+	return map[string]interface{}{
+		"type": "json_schema",
+		"json_schema": map[string]interface{}{
+			"name":   "labels",
+			"strict": true,
+			"schema": map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"labels": map[string]interface{}{
+						"type":     "array",
+						"items":    map[string]interface{}{"type": "string"},
+						"minItems": count,
+						"maxItems": count,
+					},
+				},
+				"required":             []string{"labels"},
+				"additionalProperties": false,
+			},
+		},
+	}
+}
+
+// openAIPrompt lays the candidate prompt out as the user message
+func openAIPrompt(c ContextCandidate) (string, error) {
+	prompt := CandidatePrompt(c)
+	known, err := json.Marshal(prompt["known"])
+	if err != nil {
+		return "", err
+	}
+
+	var message strings.Builder
+	fmt.Fprintf(&message, "%s\n%s\n", prompt["template"], prompt["examples"])
+	fmt.Fprintf(&message, "Known labels, empty where a label is needed: %s\n", known)
+	fmt.Fprintf(&message, "Answer exactly %d labels.", prompt["label_count"])
+	if feedback, ok := prompt["feedback"]; ok {
+		fmt.Fprintf(&message, "\n%s", feedback)
+	}
+
+	return message.String(), nil
+}
+
+func (op *OpenAIProvider) Contextualise(ctx context.Context, input ContextCandidate) (Context, error) {
+	prompt, err := openAIPrompt(input)
+	if err != nil {
+		return Context{}, err
+	}
+
+	body, err := json.Marshal(openAIRequest{
+		Model: op.model,
+		Messages: []openAIMessage{
+			{Role: "system", Content: openAIInstructions},
+			{Role: "user", Content: prompt},
+		},
+		ResponseFormat: labelsSchema(input.ExpectedLabels()),
+	})
+	if err != nil {
+		return Context{}, err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, op.endpoint+"/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return Context{}, err
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	if op.apiKey != "" {
+		request.Header.Set("Authorization", "Bearer "+op.apiKey)
+	}
+
+	response, err := op.client.Do(request)
+	if err != nil {
+		return Context{}, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		detail, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		err := fmt.Errorf("chat completions: %s: %s", response.Status, bytes.TrimSpace(detail))
+
+		if permanentStatus(response.StatusCode) {
+			return Context{}, fmt.Errorf("%w: %w", ErrPermanent, err)
+		}
+
+		return Context{}, err
+	}
+
+	var completion openAIResponse
+	if err := json.NewDecoder(response.Body).Decode(&completion); err != nil {
+		return Context{}, fmt.Errorf("chat completions: %w", err)
+	}
+
+	if len(completion.Choices) == 0 {
+		return Context{}, fmt.Errorf("chat completions: no choices in response")
+	}
+
+	var answer ContextualiseResponse
+	if err := json.Unmarshal([]byte(completion.Choices[0].Message.Content), &answer); err != nil {
+		return Context{}, fmt.Errorf("chat completions: answer is not a labels object: %w", err)
+	}
+
+	return Context{labels: answer.Labels}, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// OpenAIProviderTestSuite provides test suite for OpenAIProvider against a stand-in server
+type OpenAIProviderTestSuite struct {
+	suite.Suite
+	server   *httptest.Server
+	status   int
+	answer   string
+	received openAIRequest
+	header   http.Header
+	path     string
+}
+
+func (suite *OpenAIProviderTestSuite) SetupTest() {
+	suite.status = http.StatusOK
+	suite.answer = `{"labels":["event","key","pid"]}`
+	suite.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		suite.path = r.URL.Path
+		suite.header = r.Header.Clone()
+		suite.NoError(json.NewDecoder(r.Body).Decode(&suite.received))
+
+		w.WriteHeader(suite.status)
+		if suite.status != http.StatusOK {
+			w.Write([]byte(`{"error":"nope"}`))
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []map[string]interface{}{
+				{"message": map[string]string{"role": "assistant", "content": suite.answer}},
+			},
+		})
+	}))
+}
+
+func (suite *OpenAIProviderTestSuite) TearDownTest() {
+	suite.server.Close()
+}
+
+func (suite *OpenAIProviderTestSuite) candidate() ContextCandidate {
+	return ContextCandidate{
+		Mask:    LogMask("Y Y=Y"),
+		Samples: []LogLine{LogLine("start pid=<1>")},
+		Known:   []string{"", "key", "pid"},
+	}
+}
+
+func (suite *OpenAIProviderTestSuite) TestLabelsFromAnswer() {
+	provider := NewOpenAIProvider(suite.server.URL+"/v1/", "local", "secret")
+
+	context, err := provider.Contextualise(context.Background(), suite.candidate())
+	suite.NoError(err)
+	suite.Equal([]string{"event", "key", "pid"}, context.labels)
+
+	suite.Equal("/v1/chat/completions", suite.path)
+	suite.Equal("Bearer secret", suite.header.Get("Authorization"))
+	suite.Equal("local", suite.received.Model)
+}
+
+func (suite *OpenAIProviderTestSuite) TestSendsCandidateAndSchema() {
+	provider := NewOpenAIProvider(suite.server.URL, "", "")
+	candidate := suite.candidate()
+	candidate.Feedback = "answer exactly 3 labels"
+
+	_, err := provider.Contextualise(context.Background(), candidate)
+	suite.NoError(err)
+
+	suite.Empty(suite.header.Get("Authorization"))
+	suite.Len(suite.received.Messages, 2)
+	user := suite.received.Messages[1].Content
+	suite.Contains(user, "<template>Y Y=Y</template>")
+	suite.Contains(user, "<i>start pid=&lt;1&gt;</i>")
+	suite.Contains(user, `["","key","pid"]`)
+	suite.Contains(user, "answer exactly 3 labels")
+
+	schema := suite.received.ResponseFormat["json_schema"].(map[string]interface{})["schema"].(map[string]interface{})
+	labels := schema["properties"].(map[string]interface{})["labels"].(map[string]interface{})
+	suite.Equal(float64(3), labels["minItems"])
+	suite.Equal(float64(3), labels["maxItems"])
+}
+
+func (suite *OpenAIProviderTestSuite) TestRejectedRequestsArePermanent() {
+	suite.status = http.StatusBadRequest
+	provider := NewOpenAIProvider(suite.server.URL, "", "")
+
+	_, err := provider.Contextualise(context.Background(), suite.candidate())
+	suite.ErrorIs(err, ErrPermanent)
+	suite.ErrorContains(err, "nope")
+}
+
+func (suite *OpenAIProviderTestSuite) TestUnavailableServersAreRetried() {
+	suite.status = http.StatusServiceUnavailable
+	provider := NewOpenAIProvider(suite.server.URL, "", "")
+
+	_, err := provider.Contextualise(context.Background(), suite.candidate())
+	suite.Error(err)
+	suite.NotErrorIs(err, ErrPermanent)
+}
+
+func (suite *OpenAIProviderTestSuite) TestMalformedAnswer() {
+	suite.answer = "pid and event"
+	provider := NewOpenAIProvider(suite.server.URL, "", "")
+
+	_, err := provider.Contextualise(context.Background(), suite.candidate())
+	suite.ErrorContains(err, "not a labels object")
+}
+
+func TestOpenAIProviderTestSuite(t *testing.T) {
+	suite.Run(t, new(OpenAIProviderTestSuite))
+}
@@ -0,0 +1,140 @@
+package main
+
+// Most lines are largely key=value pairs, whose values can be labelled with their key without
+// asking the contextualiser. Pairs are recognised from the symbols around a token, which are
+// part of the mask, so every line of a mask has its pairs at the same positions.
+const pairKeyLabel = "key" // Label of the tokens that make up a key
+
+func isKeyRune(r rune) bool {
+	return isAlphaNumeric(r) || r == '_' || r == '.' || r == '-'
+}
+
+// pairKey returns where the key of the value starting at start begins and ends, or ok false when
+// the value is not part of a k=v, k="v" or k: v pair
+func pairKey(line LogLine, start int) (int, int, bool) {
+	end := -1
+	colon := false
+	switch {
+	case start >= 1 && line[start-1] == '=':
+		end = start - 1
+	case start >= 2 && (line[start-1] == '"' || line[start-1] == '\'') && line[start-2] == '=':
+		end = start - 2
+	case start >= 2 && line[start-1] == ' ' && line[start-2] == ':':
+		end, colon = start-2, true
+	default:
+		return 0, 0, false
+	}
+
+	begin := end
+	for begin > 0 && isKeyRune(line[begin-1]) {
+		begin--
+	}
+
+	if begin == end {
+		return 0, 0, false
+	}
+
+	// "Tag: message" reads like a key but is free text, so colon keys must start a line or a list item
+	if colon {
+		previous := begin - 1
+		for previous >= 0 && line[previous] == ' ' {
+			previous--
+		}
+
+		if previous >= 0 {
+			_, opening := enclosingSymbols[line[previous]]
+			if !listSeparators[line[previous]] && !opening {
+				return 0, 0, false
+			}
+		}
+	}
+
+	return begin, end, true
+}
+
+// PairLabels returns one label per token of the sentence: the key name for pair values, pairKeyLabel
+// for the tokens of a key, and an empty label for every other token. Sentences without spans,
+// such as those of the drain consumer, get no pair labels.
+func PairLabels(s Sentence) []string {
+	labels := make([]string, len(s.Tokens))
+	if len(s.Spans) != len(s.Tokens) {
+		return labels
+	}
+
+	for i, span := range s.Spans {
+		begin, end, ok := pairKey(s.Line, span.Start)
+		if !ok {
+			continue
+		}
+
+		labels[i] = string(s.Line[begin:end])
+
+		// Values take precedence over keys, as in "a=b=c"
+		for k := i - 1; k >= 0 && s.Spans[k].Start >= begin; k-- {
+			if labels[k] == "" {
+				labels[k] = pairKeyLabel
+			}
+		}
+	}
+
+	return labels
+}
+
+// OverlayPairLabels replaces labels of pair positions with the pair labels of the sentence, so
+// lines sharing a mask are labelled with their own key names
+func OverlayPairLabels(labels []string, s Sentence) []string {
+	pairs := PairLabels(s)
+	if len(pairs) != len(labels) {
+		return labels
+	}
+
+	overlaid := make([]string, len(labels))
+	for i, label := range labels {
+		overlaid[i] = label
+		if pairs[i] != "" {
+			overlaid[i] = pairs[i]
+		}
+	}
+
+	return overlaid
+}
+
+// knownLabels counts the labels that were extracted without the contextualiser
+func knownLabels(labels []string) int {
+	var known int
+	for _, label := range labels {
+		if label != "" {
+			known++
+		}
+	}
+
+	return known
+}
+
+// FillLabels completes known labels with the labels of the contextualiser, which either answered
+// only the unknown positions in order or every position
+func FillLabels(known []string, answered []string) ([]string, bool) {
+	filled := make([]string, len(known))
+	copy(filled, known)
+
+	switch len(answered) {
+	case len(known) - knownLabels(known):
+		next := 0
+		for i := range filled {
+			if filled[i] == "" {
+				filled[i] = answered[next]
+				next++
+			}
+		}
+	case len(known):
+		for i := range filled {
+			if filled[i] == "" {
+				filled[i] = answered[i]
+			}
+		}
+	default:
+		return nil, false
+	}
+
+	return filled, true
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// PairsTestSuite provides test suite for key=value pair extraction
+type PairsTestSuite struct {
+	suite.Suite
+	consumer *MaskConsumer
+	helper   *TestHelper
+}
+
+func (suite *PairsTestSuite) SetupTest() {
+	suite.consumer = NewMaskConsumer()
+	suite.helper = &TestHelper{}
+}
+
+func (suite *PairsTestSuite) TestPairLabels() {
+	testCases := []struct {
+		name     string
+		line     string
+		expected []string
+	}{
+		{"equals", "pid=1702, uid=1000", []string{"key", "pid", "key", "uid"}},
+		{"quoted", `tag="*launch*"`, []string{"key", "tag"}},
+		{"colon list", "status: ok, code: 200", []string{"key", "status", "key", "code"}},
+		{"compound key", "pid_max=5", []string{"key", "key", "pid_max"}},
+		{"embedded key", "release:lock=1", []string{"", "key", "lock"}},
+		{"enclosed value", "ws=WorkSource{10113}", []string{"key", "ws", ""}},
+		{"free text colon", "D PowerManagerService: acquire", []string{"", "", ""}},
+		{"no pairs", "03-17 16:13:45.382", []string{"", "", "", "", "", ""}},
+	}
+
+	for _, tc := range testCases {
+		suite.Run(tc.name, func() {
+			sentence, err := suite.consumer.Mask([]rune(tc.line))
+			suite.NoError(err)
+			suite.Equal(tc.expected, PairLabels(sentence))
+		})
+	}
+}
+
+func (suite *PairsTestSuite) TestPairLabelsWithoutSpans() {
+	sentence := suite.helper.CreateTestSentence("pid=1702", []string{"pid", "1702"}, "Y=Y")
+
+	suite.Equal([]string{"", ""}, PairLabels(sentence))
+}
+
+func (suite *PairsTestSuite) TestFillLabels() {
+	known := []string{"", "key", "pid"}
+
+	filled, ok := FillLabels(known, []string{"level"})
+	suite.True(ok)
+	suite.Equal([]string{"level", "key", "pid"}, filled)
+
+	filled, ok = FillLabels(known, []string{"level", "name", "value"})
+	suite.True(ok)
+	suite.Equal([]string{"level", "key", "pid"}, filled)
+
+	_, ok = FillLabels(known, []string{"level", "name"})
+	suite.False(ok)
+}
+
+func (suite *PairsTestSuite) TestLabellerUsesKeysOfEachLine() {
+	// Both lines share a mask, the context was built from the first one
+	first, err := suite.consumer.Mask([]rune("I pid=1702"))
+	suite.NoError(err)
+	second, err := suite.consumer.Mask([]rune("W uid=1000"))
+	suite.NoError(err)
+	suite.Equal(first.Fingerprint, second.Fingerprint)
+
+	labeller := NewTokenLabeller(NewContextStore())
+	context := suite.helper.CreateTestContext([]string{"level", "key", "pid"})
+
+	result, err := labeller.LabelTokens(context, second)
+	suite.NoError(err)
+	suite.Equal([]Token{Token("W")}, result.data["level"])
+	suite.Equal([]Token{Token("uid")}, result.data["key"])
+	suite.Equal([]Token{Token("1000")}, result.data["uid"])
+	suite.NotContains(result.data, TokenLabel("pid"))
+}
+
+func (suite *PairsTestSuite) TestContextualiserSkipsFullyKnownMasks() {
+	contextRegistry := NewContextStore()
+	maskRegistry := NewMaskStatusStore()
+	contextualiser := NewSentenceContextualiser(NewFakeContextProvider(), contextRegistry, maskRegistry, NewTemplateStore(), nil, false, nil)
+
+	sentence, err := suite.consumer.Mask([]rune("pid=1702, uid=1000"))
+	suite.NoError(err)
+
+	registered := make(chan Sentence, 1)
+	suite.NoError(contextualiser.accumulate(sentence, registered, nil))
+
+	suite.Equal(sentence.Line, (<-registered).Line)
+	status, err := maskRegistry.Get(sentence.Fingerprint)
+	suite.NoError(err)
+	suite.Equal(MaskRegistered, status.State)
+
+	context, err := contextRegistry.Get(sentence.Fingerprint)
+	suite.NoError(err)
+	suite.Equal([]string{"key", "pid", "key", "uid"}, context.labels)
+}
+
+func TestPairsTestSuite(t *testing.T) {
+	suite.Run(t, new(PairsTestSuite))
+}
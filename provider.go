@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/braintrustdata/braintrust-go"
+)
+
+// ContextProvider labels the positions of a mask from a candidate. The contextualiser only talks to
+// a provider, so backends can be swapped without touching accumulation or registration.
+type ContextProvider interface {
+	Contextualise(context.Context, ContextCandidate) (Context, error)
+}
+
+type ContextualiseResponse struct {
+	Labels []string `json:"labels"`
+}
+
+// ExpectedLabels is the number of labels a provider must return for the candidate, one per
+// position of Known. Masks of consumers that assign their own template IDs are literal text, so
+// positions are counted from the tokens rather than from the placeholders of the mask.
+func (c ContextCandidate) ExpectedLabels() int {
+	return len(c.Known)
+}
+
+func escapeXML(s string) string {
+	var escaped strings.Builder
+	xml.EscapeText(&escaped, []byte(s))
+	return escaped.String()
+}
+
+// CandidatePrompt builds the input of a labelling function from a candidate. The mask and samples
+// are XML escaped as the prompt wraps them in tags, and the input is JSON encoded as a whole by the
+// client. Known labels are sent as they are, empty where the function has to find one, and the
+// feedback of a rejected answer is only sent on a re-prompt.
+func CandidatePrompt(c ContextCandidate) map[string]interface{} {
+	var examples strings.Builder
+	examples.WriteString("<examples>")
+	for _, sample := range c.Samples {
+		examples.WriteString("<i>")
+		examples.WriteString(escapeXML(string(sample)))
+		examples.WriteString("</i>")
+	}
+	examples.WriteString("</examples>")
+
+	known := c.Known
+	if known == nil {
+		known = []string{}
+	}
+
+	prompt := map[string]interface{}{
+		"examples":    examples.String(),
+		"template":    "<template>" + escapeXML(string(c.Mask)) + "</template>",
+		"label_count": c.ExpectedLabels(),
+		"known":       known,
+	}
+	if c.Feedback != "" {
+		prompt["feedback"] = c.Feedback
+	}
+
+	return prompt
+}
+
+// BraintrustProvider invokes the labelling function hosted on Braintrust
+type BraintrustProvider struct {
+	client     braintrust.Client
+	functionID string
+}
+
+func NewBraintrustProvider() *BraintrustProvider {
+	return &BraintrustProvider{
+		client:     braintrust.NewClient(), // Defaults to os.LookUpEnv("BRAINTRUST_API_KEY")
+		functionID: "a26dfd04-0fd7-4a77-aa45-826560d785ab",
+	}
+}
+
+func (bp *BraintrustProvider) Contextualise(ctx context.Context, input ContextCandidate) (Context, error) {
+	// Responsible for preparing an api call to openai using the information in the input.
+	response, err := bp.client.Functions.Invoke(ctx, bp.functionID, braintrust.FunctionInvokeParams{
+		Input: CandidatePrompt(input),
+	})
+
+	var apiErr *braintrust.Error
+	if errors.As(err, &apiErr) && permanentStatus(apiErr.StatusCode) {
+		return Context{}, fmt.Errorf("%w: %w", ErrPermanent, err)
+	}
+
+	if err != nil {
+		return Context{}, err
+	}
+
+	// The response is a pointer to any, so we need to dereference it first
+	responseMap, ok := (*response).(map[string]interface{})
+	if !ok {
+		return Context{}, fmt.Errorf("failed to assert response as map[string]interface{}")
+	}
+
+	// Extract the labels field from the response
+	labelsInterface, exists := responseMap["labels"]
+	if !exists {
+		return Context{}, fmt.Errorf("labels field not found in response")
+	}
+
+	// Type assert the labels to []interface{} and convert to []string
+	labelsSlice, ok := labelsInterface.([]interface{})
+	if !ok {
+		return Context{}, fmt.Errorf("labels field is not an array")
+	}
+
+	var labels []string
+	for _, label := range labelsSlice {
+		labelStr, ok := label.(string)
+		if !ok {
+			return Context{}, fmt.Errorf("label is not a string: %v", label)
+		}
+		labels = append(labels, labelStr)
+	}
+
+	return Context{labels: labels}, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// ProviderTestSuite provides test suite for context providers and their prompts
+type ProviderTestSuite struct {
+	suite.Suite
+}
+
+func (suite *ProviderTestSuite) TestPromptCarriesCandidate() {
+	candidate := ContextCandidate{
+		Mask:    LogMask(`Y Y=Y, Y="X"`),
+		Samples: []LogLine{LogLine(`start pid=1, tag="<a & b>"`), LogLine(`stop pid=2, tag="c"`)},
+		Known:   []string{"", "key", "pid", "key", "tag"},
+	}
+
+	prompt := CandidatePrompt(candidate)
+
+	suite.Equal("<template>Y Y=Y, Y=&#34;X&#34;</template>", prompt["template"])
+	suite.Equal(`<examples><i>start pid=1, tag=&#34;&lt;a &amp; b&gt;&#34;</i><i>stop pid=2, tag=&#34;c&#34;</i></examples>`, prompt["examples"])
+	suite.Equal(5, prompt["label_count"])
+	suite.Equal(candidate.Known, prompt["known"])
+}
+
+func (suite *ProviderTestSuite) TestPromptEncodesAsJSON() {
+	candidate := ContextCandidate{
+		Mask:    LogMask("Y Y"),
+		Samples: []LogLine{LogLine("say \"hi\"\t\\ \u0001")},
+	}
+
+	encoded, err := json.Marshal(CandidatePrompt(candidate))
+	suite.NoError(err)
+
+	var decoded map[string]interface{}
+	suite.NoError(json.Unmarshal(encoded, &decoded))
+	suite.Equal(CandidatePrompt(candidate)["examples"], decoded["examples"])
+	suite.Equal([]interface{}{}, decoded["known"])
+}
+
+func (suite *ProviderTestSuite) TestExpectedLabelsOfFoldedMask() {
+	consumer := NewMaskConsumer(WithRepetitionFolding())
+	sentence, err := consumer.Mask([]rune("users a=1, b=2, c=3;"))
+	suite.NoError(err)
+
+	candidate := ContextCandidate{Mask: sentence.Mask, Known: FoldLabels(PairLabels(sentence), sentence.Repetitions)}
+	suite.Equal(len(candidate.Known), candidate.ExpectedLabels())
+}
+
+func TestProviderTestSuite(t *testing.T) {
+	suite.Run(t, new(ProviderTestSuite))
+}
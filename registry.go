@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Every change to Maskify, Compress, enclosingSymbols or FoldRepetitions that can change a mask
+// must bump maskVersion. Registry entries are stamped with the version their mask was computed under,
+// and entries of another version have to be migrated before their contexts can be used again.
+const maskVersion = 2
+
+// Number of sample lines kept per mask so the registry can be re-masked by a later version
+const keptSamples = 3
+
+// RegistryEntry is the persisted form of everything known about a single mask
+type RegistryEntry struct {
+	MaskVersion int      `json:"mask_version"`
+	TemplateID  string   `json:"template_id"`
+	Mask        string   `json:"mask"`
+	Registered  bool     `json:"registered"`
+	Labels      []string `json:"labels,omitempty"`
+	Samples     []string `json:"samples,omitempty"`
+}
+
+func NewSampleLineStore() *MemoryStore[[]LogLine] {
+	return &MemoryStore[[]LogLine]{
+		data: make(map[Fingerprint][]LogLine),
+	}
+}
+
+// SnapshotRegistry collects one entry per known mask
+func SnapshotRegistry(templates *MemoryStore[LogMask], maskRegistry *MemoryStore[MaskStatus], contextRegistry *MemoryStore[Context], sampleLines *MemoryStore[[]LogLine]) []RegistryEntry {
+	var entries []RegistryEntry
+	for _, key := range templates.Keys() {
+		mask, _ := templates.Get(key)
+		status, _ := maskRegistry.Get(key)
+		context, _ := contextRegistry.Get(key)
+		lines, _ := sampleLines.Get(key)
+
+		entry := RegistryEntry{
+			MaskVersion: maskVersion,
+			TemplateID:  key.String(),
+			Mask:        string(mask),
+			Registered:  status.State == MaskRegistered,
+			Labels:      context.labels,
+		}
+
+		for _, line := range lines {
+			entry.Samples = append(entry.Samples, string(line))
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+// entryKey returns the key of an entry and whether it is the literal template of a consumer that
+// assigns its own IDs, such as drain. Those are keyed by TemplateFingerprint and do not depend on
+// the mask version.
+func entryKey(entry RegistryEntry) (Fingerprint, bool) {
+	if key := TemplateFingerprint(entry.Mask); key.String() == entry.TemplateID {
+		return key, true
+	}
+
+	return FingerprintOf(LogMask(entry.Mask)), false
+}
+
+// RestoreRegistry loads entries of the current mask version and literal templates into the stores
+// and returns how many entries were skipped because they belong to another version
+func RestoreRegistry(entries []RegistryEntry, templates *MemoryStore[LogMask], maskRegistry *MemoryStore[MaskStatus], contextRegistry *MemoryStore[Context], sampleLines *MemoryStore[[]LogLine]) int {
+	var stale int
+	for _, entry := range entries {
+		key, template := entryKey(entry)
+		if entry.MaskVersion != maskVersion && !template {
+			stale++
+			continue
+		}
+
+		mask := LogMask(entry.Mask)
+		templates.Put(key, mask)
+		if entry.Registered {
+			registerMask(maskRegistry, key)
+		}
+		if entry.Labels != nil {
+			contextRegistry.Put(key, Context{labels: entry.Labels, mask: mask})
+		}
+
+		var lines []LogLine
+		for _, sample := range entry.Samples {
+			lines = append(lines, LogLine(sample))
+		}
+		sampleLines.Put(key, lines)
+	}
+
+	return stale
+}
+
+// SaveRegistry writes one JSON entry per line
+func SaveRegistry(filename string, entries []RegistryEntry) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+
+	return writer.Flush()
+}
+
+// LoadRegistry reads a registry written by SaveRegistry. A missing file is an empty registry.
+func LoadRegistry(filename string) ([]RegistryEntry, error) {
+	file, err := os.Open(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []RegistryEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var entry RegistryEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("registry line %d: %w", line, err)
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
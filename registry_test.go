@@ -0,0 +1,116 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// RegistryTestSuite provides test suite for registry persistence
+type RegistryTestSuite struct {
+	suite.Suite
+	templates       *MemoryStore[LogMask]
+	maskRegistry    *MemoryStore[MaskStatus]
+	contextRegistry *MemoryStore[Context]
+	sampleLines     *MemoryStore[[]LogLine]
+}
+
+func (suite *RegistryTestSuite) SetupTest() {
+	suite.templates = NewTemplateStore()
+	suite.maskRegistry = NewMaskStatusStore()
+	suite.contextRegistry = NewContextStore()
+	suite.sampleLines = NewSampleLineStore()
+}
+
+func (suite *RegistryTestSuite) TestSnapshotStampsMaskVersion() {
+	key := FingerprintOf(LogMask("Y=Y"))
+	suite.templates.Put(key, LogMask("Y=Y"))
+	suite.maskRegistry.Put(key, MaskStatus{State: MaskRegistered})
+	suite.contextRegistry.Put(key, Context{labels: []string{"key", "value"}})
+	suite.sampleLines.Put(key, []LogLine{LogLine("pid=1702")})
+
+	entries := SnapshotRegistry(suite.templates, suite.maskRegistry, suite.contextRegistry, suite.sampleLines)
+
+	suite.Equal([]RegistryEntry{{
+		MaskVersion: maskVersion,
+		TemplateID:  key.String(),
+		Mask:        "Y=Y",
+		Registered:  true,
+		Labels:      []string{"key", "value"},
+		Samples:     []string{"pid=1702"},
+	}}, entries)
+}
+
+func (suite *RegistryTestSuite) TestSaveLoadRoundTrip() {
+	filename := filepath.Join(suite.T().TempDir(), "registry.jsonl")
+	entries := []RegistryEntry{
+		{MaskVersion: maskVersion, TemplateID: "a", Mask: "Y=Y", Registered: true, Labels: []string{"key", "value"}},
+		{MaskVersion: maskVersion, TemplateID: "b", Mask: "Y [X]", Samples: []string{"main [worker]"}},
+	}
+
+	suite.NoError(SaveRegistry(filename, entries))
+
+	loaded, err := LoadRegistry(filename)
+	suite.NoError(err)
+	suite.Equal(entries, loaded)
+}
+
+func (suite *RegistryTestSuite) TestLoadMissingFile() {
+	entries, err := LoadRegistry(filepath.Join(suite.T().TempDir(), "missing.jsonl"))
+	suite.NoError(err)
+	suite.Empty(entries)
+}
+
+func (suite *RegistryTestSuite) TestLoadReportsBadLine() {
+	filename := filepath.Join(suite.T().TempDir(), "registry.jsonl")
+	suite.NoError(os.WriteFile(filename, []byte("{\"mask\":\"Y\"}\nnot json\n"), 0644))
+
+	_, err := LoadRegistry(filename)
+	suite.ErrorContains(err, "registry line 2")
+}
+
+func (suite *RegistryTestSuite) TestRestoreSkipsStaleVersions() {
+	entries := []RegistryEntry{
+		{MaskVersion: maskVersion, Mask: "Y=Y", Registered: true, Labels: []string{"key", "value"}},
+		{MaskVersion: maskVersion - 1, Mask: "Y:Y", Registered: true, Labels: []string{"key", "value"}},
+	}
+
+	stale := RestoreRegistry(entries, suite.templates, suite.maskRegistry, suite.contextRegistry, suite.sampleLines)
+	suite.Equal(1, stale)
+
+	current := FingerprintOf(LogMask("Y=Y"))
+	status, err := suite.maskRegistry.Get(current)
+	suite.NoError(err)
+	suite.Equal(MaskRegistered, status.State)
+
+	context, err := suite.contextRegistry.Get(current)
+	suite.NoError(err)
+	suite.Equal([]string{"key", "value"}, context.labels)
+
+	_, err = suite.maskRegistry.Get(FingerprintOf(LogMask("Y:Y")))
+	suite.Error(err)
+}
+
+func (suite *RegistryTestSuite) TestRestoresDrainTemplatesUnderTheirKey() {
+	sentence, _ := DrainSentence([]rune("job 7 finished"), LogMask("job <*> finished"))
+	suite.templates.Put(sentence.Fingerprint, sentence.Mask)
+	registerMask(suite.maskRegistry, sentence.Fingerprint)
+	suite.contextRegistry.Put(sentence.Fingerprint, Context{labels: []string{"id"}, mask: sentence.Mask})
+
+	entries := SnapshotRegistry(suite.templates, suite.maskRegistry, suite.contextRegistry, suite.sampleLines)
+	entries[0].MaskVersion = maskVersion - 1
+
+	templates, maskRegistry, contextRegistry := NewTemplateStore(), NewMaskStatusStore(), NewContextStore()
+	suite.Zero(RestoreRegistry(entries, templates, maskRegistry, contextRegistry, NewSampleLineStore()))
+
+	context, err := contextRegistry.Get(sentence.Fingerprint)
+	suite.NoError(err)
+	suite.Equal([]string{"id"}, context.labels)
+	suite.True(isRegistered(maskRegistry, sentence.Fingerprint))
+}
+
+func TestRegistryTestSuite(t *testing.T) {
+	suite.Run(t, new(RegistryTestSuite))
+}
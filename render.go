@@ -0,0 +1,37 @@
+package main
+
+import "fmt"
+
+// Render rebuilds the line a mask was computed from. Every symbol of the mask is copied as is and
+// every placeholder is replaced by the next token, which is lossless because masks keep every
+// symbol of the line and tokens cover every alphanumeric run and enclosed segment. Only masks of
+// the mask consumer can be rendered, drain templates drop the whitespace between fields.
+func Render(mask LogMask, tokens []Token) (LogLine, error) {
+	if count := countPlaceholders(mask); count != len(tokens) {
+		return nil, fmt.Errorf("mask has %d placeholders for %d tokens", count, len(tokens))
+	}
+
+	size := len(mask)
+	for _, token := range tokens {
+		size += len(token)
+	}
+
+	line := make(LogLine, 0, size)
+	next := 0
+	for _, r := range mask {
+		if !isPlaceholder(r) {
+			line = append(line, r)
+			continue
+		}
+
+		line = append(line, tokens[next]...)
+		next++
+	}
+
+	return line, nil
+}
+
+// RenderSentence rebuilds the line of a sentence, expanding folded repetitions first
+func RenderSentence(s Sentence) (LogLine, error) {
+	return Render(ExpandRepetitions(s.Mask, s.Repetitions), s.Tokens)
+}
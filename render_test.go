@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"testing"
+	"testing/quick"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// RenderTestSuite provides test suite for rebuilding lines from masks and tokens
+type RenderTestSuite struct {
+	suite.Suite
+	consumers []*MaskConsumer
+	helper    *TestHelper
+}
+
+func (suite *RenderTestSuite) SetupTest() {
+	suite.consumers = []*MaskConsumer{
+		NewMaskConsumer(),
+		NewMaskConsumer(WithRepetitionFolding()),
+		NewMaskConsumer(WithStructuredFields()),
+	}
+	suite.helper = &TestHelper{}
+}
+
+func (suite *RenderTestSuite) TestRender() {
+	tokens := []Token{Token("pid"), Token("1702"), Token("*launch*")}
+
+	line, err := Render(LogMask(`Y=Y  tag="X"`), tokens)
+	suite.NoError(err)
+	suite.Equal(`pid=1702  tag="*launch*"`, string(line))
+}
+
+func (suite *RenderTestSuite) TestRenderRejectsMismatch() {
+	_, err := Render(LogMask("Y=Y"), []Token{Token("pid")})
+	suite.Error(err)
+}
+
+func (suite *RenderTestSuite) TestRenderFoldedSentence() {
+	sentence, err := suite.consumers[1].Mask([]rune("users=a, b, c;"))
+	suite.NoError(err)
+	suite.Equal("Y=RY, EY;", string(sentence.Mask))
+
+	line, err := RenderSentence(sentence)
+	suite.NoError(err)
+	suite.Equal("users=a, b, c;", string(line))
+}
+
+func (suite *RenderTestSuite) TestTestdataRoundTrip() {
+	for _, name := range []string{"sample.log", "malformed.log", "empty.log"} {
+		file, err := os.Open(suite.helper.GetTestDataPath(name))
+		suite.Require().NoError(err)
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			for _, consumer := range suite.consumers {
+				sentence, err := consumer.Mask([]rune(scanner.Text()))
+				suite.NoError(err, scanner.Text())
+
+				line, err := RenderSentence(sentence)
+				suite.NoError(err, scanner.Text())
+				suite.Equal(scanner.Text(), string(line))
+			}
+		}
+		file.Close()
+	}
+}
+
+func TestRenderTestSuite(t *testing.T) {
+	suite.Run(t, new(RenderTestSuite))
+}
+
+func TestRenderRoundTripProperty(t *testing.T) {
+	consumers := []*MaskConsumer{NewMaskConsumer(), NewMaskConsumer(WithRepetitionFolding())}
+	lossless := func(line logLike) bool {
+		for _, consumer := range consumers {
+			sentence, err := consumer.Mask([]rune(string(line)))
+			if err != nil {
+				return false
+			}
+
+			rendered, err := RenderSentence(sentence)
+			if err != nil || string(rendered) != string(line) {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	if err := quick.Check(lossless, &quick.Config{MaxCount: 5000}); err != nil {
+		t.Error(err)
+	}
+}
+
+// FuzzRender checks that every line survives masking and rendering byte for byte. Seeds live in
+// testdata/fuzz/FuzzRender, run `go test -fuzz FuzzRender` to search for more.
+func FuzzRender(f *testing.F) {
+	f.Add(`03-17 16:13:38.936  1702 14638 D PowerManagerService: release:lock=189667585, flg=0x0, tag="*launch*", name=android", ws=WorkSource{10113}, uid=1000, pid=1702`)
+	f.Add("users=a, b, c;")
+
+	consumers := []*MaskConsumer{NewMaskConsumer(), NewMaskConsumer(WithRepetitionFolding())}
+	f.Fuzz(func(t *testing.T, line string) {
+		// Lines are runes, invalid UTF-8 is replaced when it is read
+		if !utf8.ValidString(line) {
+			t.Skip()
+		}
+
+		for _, consumer := range consumers {
+			sentence, err := consumer.Mask([]rune(line))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rendered, err := RenderSentence(sentence)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(rendered) != line {
+				t.Fatalf("rendered %q from mask %q, want %q", string(rendered), string(sentence.Mask), line)
+			}
+		}
+	})
+}
@@ -0,0 +1,253 @@
+package main
+
+// Lists like "k1=v1, k2=v2, k3=v3" produce a different mask for every length. Folding
+// rewrites a run of identical list units into a single unit wrapped in repetition markers,
+// so "Y=Y, Y=Y, Y=Y" becomes "RY=Y, EY=Y". Markers are letters because every letter of the
+// input is masked, so they can never clash with a literal symbol.
+const (
+	repetitionStart = 'R'
+	repetitionEnd   = 'E'
+)
+
+// Longest list unit considered, in runes of the mask. List units are short once their enclosures
+// are masked, and the bound keeps folding linear in the length of the line.
+const maxUnitLength = 64
+
+var listSeparators = map[rune]bool{
+	',': true,
+	';': true,
+	'&': true,
+	'|': true,
+}
+
+// Repetition records how a folded unit expands back into the tokens of a sentence
+type Repetition struct {
+	FirstToken int // Index of the first token covered by the unit
+	Width      int // Tokens per unit
+	Count      int // Times the unit repeats in the original line
+}
+
+func countPlaceholders(mask []rune) int {
+	var count int
+	for _, r := range mask {
+		if isPlaceholder(r) {
+			count++
+		}
+	}
+
+	return count
+}
+
+// listUnitEnds returns the exclusive ends of candidate units starting at i. A unit starts with
+// a placeholder, ends with a run of symbols containing a list separator and is at most
+// maxUnitLength long.
+func listUnitEnds(mask LogMask, i int) []int {
+	var ends []int
+	limit := min(len(mask), i+maxUnitLength+1)
+	for j := i + 1; j < limit; j++ {
+		if isPlaceholder(mask[j]) {
+			continue
+		}
+
+		// Find the whole symbol run so the unit ends on a separator boundary
+		k := j
+		separator := false
+		for k < limit && !isPlaceholder(mask[k]) {
+			separator = separator || listSeparators[mask[k]]
+			k++
+		}
+
+		if separator && k < len(mask) && isPlaceholder(mask[k]) {
+			ends = append(ends, k)
+		}
+
+		j = k - 1
+	}
+
+	return ends
+}
+
+func equalRunes(a, b []rune) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// repeats counts consecutive copies of unit at i and whether they are followed by the unit's item
+// (the unit without its trailing separator), which is how most lists end
+func repeats(mask LogMask, i int, unit []rune) (int, bool) {
+	var count int
+	for i+(count+1)*len(unit) <= len(mask) && equalRunes(mask[i+count*len(unit):i+(count+1)*len(unit)], unit) {
+		count++
+	}
+
+	// The item ends where the separator of the trailing symbol run starts
+	item := len(unit)
+	for item > 0 && !isPlaceholder(unit[item-1]) {
+		item--
+	}
+
+	for item < len(unit) && !listSeparators[unit[item]] {
+		item++
+	}
+
+	rest := mask[i+count*len(unit):]
+	tail := len(rest) >= item && equalRunes(rest[:item], unit[:item])
+	return count, tail
+}
+
+// FoldRepetitions folds repeated list units in a compressed mask. A unit is folded when it repeats
+// at least twice, or once when followed by a final item, so lists of two or more items share a mask.
+func FoldRepetitions(mask LogMask) (LogMask, []Repetition) {
+	var folded LogMask
+	var repetitions []Repetition
+	var tokens int
+
+	for i := 0; i < len(mask); {
+		if !isPlaceholder(mask[i]) {
+			folded = append(folded, mask[i])
+			i++
+			continue
+		}
+
+		// Prefer the unit that covers the most of the mask
+		bestEnd, bestCount, bestCovered := 0, 0, 0
+		for _, end := range listUnitEnds(mask, i) {
+			count, tail := repeats(mask, i, mask[i:end])
+			if count < 2 && !(count == 1 && tail) {
+				continue
+			}
+
+			if covered := count * (end - i); covered > bestCovered {
+				bestEnd, bestCount, bestCovered = end, count, covered
+			}
+		}
+
+		if bestCount == 0 {
+			folded = append(folded, mask[i])
+			tokens++
+			i++
+			continue
+		}
+
+		unit := mask[i:bestEnd]
+		width := countPlaceholders(unit)
+		repetitions = append(repetitions, Repetition{
+			FirstToken: tokens,
+			Width:      width,
+			Count:      bestCount,
+		})
+
+		folded = append(folded, repetitionStart)
+		folded = append(folded, unit...)
+		folded = append(folded, repetitionEnd)
+
+		tokens += width * bestCount
+		i += bestCovered
+	}
+
+	return folded, repetitions
+}
+
+// ExpandRepetitions restores the unfolded mask from a folded mask and its repetitions
+func ExpandRepetitions(mask LogMask, repetitions []Repetition) LogMask {
+	if len(repetitions) == 0 {
+		return mask
+	}
+
+	var expanded LogMask
+	var next int
+	for i := 0; i < len(mask); i++ {
+		if mask[i] != repetitionStart {
+			expanded = append(expanded, mask[i])
+			continue
+		}
+
+		end := i + 1
+		for end < len(mask) && mask[end] != repetitionEnd {
+			end++
+		}
+
+		count := 1
+		if next < len(repetitions) {
+			count = repetitions[next].Count
+		}
+		next++
+
+		for c := 0; c < count; c++ {
+			expanded = append(expanded, mask[i+1:end]...)
+		}
+		i = end
+	}
+
+	return expanded
+}
+
+// ExpandLabels turns labels of a folded mask into one label per token of the sentence,
+// reusing the labels of a folded unit for every repetition
+func ExpandLabels(labels []string, repetitions []Repetition) []string {
+	if len(repetitions) == 0 {
+		return labels
+	}
+
+	var expanded []string
+	var label int
+	for _, r := range repetitions {
+		// Labels between the previous unit and this one map one to one
+		for len(expanded) < r.FirstToken && label < len(labels) {
+			expanded = append(expanded, labels[label])
+			label++
+		}
+
+		end := min(label+r.Width, len(labels))
+		for c := 0; c < r.Count; c++ {
+			expanded = append(expanded, labels[label:end]...)
+		}
+		label = end
+	}
+
+	return append(expanded, labels[label:]...)
+}
+
+// FoldLabels is the inverse of ExpandLabels, keeping the labels of the first repetition of each
+// folded unit
+func FoldLabels(labels []string, repetitions []Repetition) []string {
+	if len(repetitions) == 0 {
+		return labels
+	}
+
+	var folded []string
+	var token int
+	for _, r := range repetitions {
+		for token < r.FirstToken && token < len(labels) {
+			folded = append(folded, labels[token])
+			token++
+		}
+
+		end := min(token+r.Width, len(labels))
+		folded = append(folded, labels[token:end]...)
+		token = min(r.FirstToken+r.Width*r.Count, len(labels))
+	}
+
+	return append(folded, labels[token:]...)
+}
+
+// RepetitionIndex returns which repetition of a folded unit a token belongs to, or -1 when the
+// token is outside every folded unit
+func (s Sentence) RepetitionIndex(token int) int {
+	for _, r := range s.Repetitions {
+		if token >= r.FirstToken && token < r.FirstToken+r.Width*r.Count {
+			return (token - r.FirstToken) / r.Width
+		}
+	}
+
+	return -1
+}
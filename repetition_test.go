@@ -0,0 +1,142 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// RepetitionTestSuite provides test suite for repetition folding
+type RepetitionTestSuite struct {
+	suite.Suite
+	consumer *MaskConsumer
+	helper   *TestHelper
+}
+
+func (suite *RepetitionTestSuite) SetupTest() {
+	suite.consumer = NewMaskConsumer(WithRepetitionFolding())
+	suite.helper = &TestHelper{}
+}
+
+func (suite *RepetitionTestSuite) TestFoldRepetitions() {
+	testCases := []struct {
+		name        string
+		mask        string
+		expected    string
+		repetitions []Repetition
+	}{
+		{"no list", "Y-Y Y:Y:Y.Y", "Y-Y Y:Y:Y.Y", nil},
+		{"single pair", "Y=Y", "Y=Y", nil},
+		{"two pairs", "Y=Y, Y=Y", "RY=Y, EY=Y", []Repetition{{FirstToken: 0, Width: 2, Count: 1}}},
+		{"three pairs", "Y=Y, Y=Y, Y=Y", "RY=Y, EY=Y", []Repetition{{FirstToken: 0, Width: 2, Count: 2}}},
+		{"prefixed list", "Y: Y=Y, Y=Y, Y=Y", "Y: RY=Y, EY=Y", []Repetition{{FirstToken: 1, Width: 2, Count: 2}}},
+		{"single items", "Y=Y, Y, Y;", "Y=RY, EY;", []Repetition{{FirstToken: 1, Width: 1, Count: 2}}},
+		{"enclosed items", "Y[X], Y[X], Y[X]", "RY[X], EY[X]", []Repetition{{FirstToken: 0, Width: 2, Count: 2}}},
+		{"trailing separator", "Y=Y; Y=Y; ", "RY=Y; E", []Repetition{{FirstToken: 0, Width: 2, Count: 2}}},
+	}
+
+	for _, tc := range testCases {
+		suite.Run(tc.name, func() {
+			folded, repetitions := FoldRepetitions(LogMask(tc.mask))
+
+			suite.Equal(tc.expected, string(folded))
+			suite.Equal(tc.repetitions, repetitions)
+			suite.Equal(tc.mask, string(ExpandRepetitions(folded, repetitions)))
+		})
+	}
+}
+
+func (suite *RepetitionTestSuite) TestLongUnitsAreNotFolded() {
+	item := "Y" + strings.Repeat("-", maxUnitLength)
+	mask := LogMask(item + ", " + item + ", " + item)
+
+	folded, repetitions := FoldRepetitions(mask)
+
+	suite.Equal(mask, folded)
+	suite.Empty(repetitions)
+}
+
+func (suite *RepetitionTestSuite) TestFoldLongLine() {
+	// Every placeholder used to scan the rest of the line for the end of a unit
+	line := strings.Repeat("a b; ", 20000)
+
+	sentence, err := suite.consumer.Mask([]rune(line))
+
+	suite.NoError(err)
+	suite.Equal("RY Y; E", string(sentence.Mask))
+	suite.NoError(CheckAlignment(sentence))
+}
+
+func (suite *RepetitionTestSuite) TestVariableLengthListsShareMask() {
+	lines := []string{
+		"config k1=v1, k2=v2;",
+		"config k1=v1, k2=v2, k3=v3;",
+		"config k1=v1, k2=v2, k3=v3, k4=v4;",
+	}
+
+	var masks []string
+	for _, line := range lines {
+		sentence, err := suite.consumer.Mask([]rune(line))
+		suite.NoError(err)
+		masks = append(masks, string(sentence.Mask))
+	}
+
+	suite.Equal(masks[0], masks[1])
+	suite.Equal(masks[0], masks[2])
+}
+
+func (suite *RepetitionTestSuite) TestTokensKeepEveryElement() {
+	sentence, err := suite.consumer.Mask([]rune("users=a, b, c;"))
+	suite.NoError(err)
+
+	suite.Equal("Y=RY, EY;", string(sentence.Mask))
+	suite.Len(sentence.Tokens, 4)
+	suite.Equal(-1, sentence.RepetitionIndex(0))
+	suite.Equal(0, sentence.RepetitionIndex(1))
+	suite.Equal(1, sentence.RepetitionIndex(2))
+	suite.Equal(-1, sentence.RepetitionIndex(3))
+}
+
+func (suite *RepetitionTestSuite) TestFoldingDisabledByDefault() {
+	sentence, err := NewMaskConsumer().Mask([]rune("users=a, b, c;"))
+	suite.NoError(err)
+
+	suite.Equal("Y=Y, Y, Y;", string(sentence.Mask))
+	suite.Empty(sentence.Repetitions)
+}
+
+func (suite *RepetitionTestSuite) TestExpandLabels() {
+	repetitions := []Repetition{{FirstToken: 1, Width: 2, Count: 3}}
+
+	labels := ExpandLabels([]string{"tag", "key", "value", "pid"}, repetitions)
+
+	suite.Equal([]string{"tag", "key", "value", "key", "value", "key", "value", "pid"}, labels)
+}
+
+func (suite *RepetitionTestSuite) TestFoldLabels() {
+	repetitions := []Repetition{{FirstToken: 1, Width: 2, Count: 3}}
+	labels := []string{"tag", "key", "value", "key", "value", "key", "value", "pid"}
+
+	folded := FoldLabels(labels, repetitions)
+
+	suite.Equal([]string{"tag", "key", "value", "pid"}, folded)
+	suite.Equal(labels, ExpandLabels(folded, repetitions))
+}
+
+func (suite *RepetitionTestSuite) TestLabelFoldedSentence() {
+	sentence, err := suite.consumer.Mask([]rune("users a, b, c;"))
+	suite.NoError(err)
+
+	labeller := NewTokenLabeller(NewContextStore())
+	context := suite.helper.CreateTestContext([]string{"field", "user", "user"})
+
+	result, err := labeller.LabelTokens(context, sentence)
+	suite.NoError(err)
+	suite.Equal([]Token{Token("a"), Token("b"), Token("c")}, result.data["user"])
+	suite.Equal([]Token{Token("users")}, result.data["field"])
+}
+
+func TestRepetitionTestSuite(t *testing.T) {
+	suite.Run(t, new(RepetitionTestSuite))
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+// ErrPermanent marks provider errors that retrying cannot fix, such as rejected credentials
+var ErrPermanent = errors.New("permanent provider error")
+
+// permanentStatus reports whether retrying cannot fix a request an API rejected with the status
+// code, which holds for client errors other than rate limits and timeouts
+func permanentStatus(code int) bool {
+	return code >= 400 && code < 500 && code != http.StatusTooManyRequests && code != http.StatusRequestTimeout
+}
+
+// RetryPolicy bounds how often the contextualiser asks a provider about a mask. Failed calls are
+// retried after an exponential backoff with full jitter, responses with the wrong number of labels
+// are re-prompted straight away with the error as feedback.
+type RetryPolicy struct {
+	Attempts  int           // Calls per mask, including the first
+	BaseDelay time.Duration // Backoff before the first retry
+	MaxDelay  time.Duration // Backoff cap
+}
+
+var defaultRetryPolicy = RetryPolicy{
+	Attempts:  4,
+	BaseDelay: 500 * time.Millisecond,
+	MaxDelay:  10 * time.Second,
+}
+
+// backoff returns a random delay up to BaseDelay doubled for every earlier retry, capped at MaxDelay
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	ceiling := p.MaxDelay
+	if shift := retry - 1; shift < 32 && p.BaseDelay<<shift < p.MaxDelay && p.BaseDelay<<shift > 0 {
+		ceiling = p.BaseDelay << shift
+	}
+
+	if ceiling <= 0 {
+		return 0
+	}
+
+	return rand.N(ceiling + 1)
+}
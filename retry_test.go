@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// RetryPolicyTestSuite provides test suite for RetryPolicy
+type RetryPolicyTestSuite struct {
+	suite.Suite
+}
+
+func (suite *RetryPolicyTestSuite) TestBackoffDoublesUpToCap() {
+	policy := RetryPolicy{Attempts: 10, BaseDelay: 10 * time.Millisecond, MaxDelay: 50 * time.Millisecond}
+	ceilings := []time.Duration{10, 20, 40, 50, 50, 50}
+
+	for i, ceiling := range ceilings {
+		for j := 0; j < 100; j++ {
+			delay := policy.backoff(i + 1)
+			suite.GreaterOrEqual(delay, time.Duration(0))
+			suite.LessOrEqual(delay, ceiling*time.Millisecond)
+		}
+	}
+}
+
+func (suite *RetryPolicyTestSuite) TestBackoffDoesNotOverflow() {
+	policy := RetryPolicy{Attempts: 100, BaseDelay: time.Second, MaxDelay: time.Minute}
+	suite.LessOrEqual(policy.backoff(80), time.Minute)
+}
+
+func (suite *RetryPolicyTestSuite) TestZeroDelay() {
+	suite.Zero(RetryPolicy{Attempts: 2}.backoff(1))
+}
+
+func TestRetryPolicyTestSuite(t *testing.T) {
+	suite.Run(t, new(RetryPolicyTestSuite))
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Rules let ops route lines without code changes. A rule file has one rule per line,
+// "<action> <field> <regex>", where action is drop, quarantine or priority and field is mask,
+// template or line. Blank lines and lines starting with # are ignored. The first matching rule wins.
+//
+//	# Heartbeats carry nothing worth labelling
+//	drop line ^.*heartbeat ok$
+//	quarantine line password=
+//	priority template ^07b2bab9f93fe8b6$
+type RuleAction int
+
+const (
+	RuleDrop       RuleAction = iota // Discard the line
+	RuleQuarantine                   // Send the line to the quarantine channel, never to the contextualiser
+	RulePriority                     // Contextualise the mask as soon as its first line arrives
+)
+
+type RuleField int
+
+const (
+	RuleFieldMask RuleField = iota
+	RuleFieldTemplate
+	RuleFieldLine
+)
+
+var ruleActions = map[string]RuleAction{
+	"drop":       RuleDrop,
+	"quarantine": RuleQuarantine,
+	"priority":   RulePriority,
+}
+
+var ruleFields = map[string]RuleField{
+	"mask":     RuleFieldMask,
+	"template": RuleFieldTemplate,
+	"line":     RuleFieldLine,
+}
+
+type Rule struct {
+	Action  RuleAction
+	Field   RuleField
+	Pattern *regexp.Regexp
+}
+
+type Rules []Rule
+
+// templateID is the template a sentence belongs to, the consumer's own ID when it assigns one
+func templateID(s Sentence) string {
+	if s.TemplateID != "" {
+		return s.TemplateID
+	}
+
+	return s.Fingerprint.String()
+}
+
+func (r Rule) Matches(s Sentence) bool {
+	switch r.Field {
+	case RuleFieldMask:
+		return r.Pattern.MatchString(string(s.Mask))
+	case RuleFieldTemplate:
+		return r.Pattern.MatchString(templateID(s))
+	default:
+		return r.Pattern.MatchString(string(s.Line))
+	}
+}
+
+// Match returns the first rule matching the sentence
+func (rs Rules) Match(s Sentence) (Rule, bool) {
+	for _, r := range rs {
+		if r.Matches(s) {
+			return r, true
+		}
+	}
+
+	return Rule{}, false
+}
+
+func ParseRules(r io.Reader) (Rules, error) {
+	var rules Rules
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		// The regex is everything after the field, so it may contain spaces
+		actionName, rest, _ := strings.Cut(text, " ")
+		fieldName, expression, _ := strings.Cut(strings.TrimSpace(rest), " ")
+		expression = strings.TrimSpace(expression)
+		if expression == "" {
+			return nil, fmt.Errorf("rule line %d: expected <action> <field> <regex>", line)
+		}
+
+		action, exists := ruleActions[actionName]
+		if !exists {
+			return nil, fmt.Errorf("rule line %d: unknown action %q", line, actionName)
+		}
+
+		field, exists := ruleFields[fieldName]
+		if !exists {
+			return nil, fmt.Errorf("rule line %d: unknown field %q", line, fieldName)
+		}
+
+		pattern, err := regexp.Compile(expression)
+		if err != nil {
+			return nil, fmt.Errorf("rule line %d: %w", line, err)
+		}
+
+		rules = append(rules, Rule{Action: action, Field: field, Pattern: pattern})
+	}
+
+	return rules, scanner.Err()
+}
+
+func LoadRules(filename string) (Rules, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ParseRules(file)
+}
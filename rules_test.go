@@ -0,0 +1,99 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// RulesTestSuite provides test suite for admin routing rules
+type RulesTestSuite struct {
+	suite.Suite
+	helper *TestHelper
+}
+
+func (suite *RulesTestSuite) SetupTest() {
+	suite.helper = &TestHelper{}
+}
+
+func (suite *RulesTestSuite) TestParseRules() {
+	rules, err := ParseRules(strings.NewReader(`
+# Comments and blank lines are skipped
+drop line heartbeat ok$
+  quarantine   mask Y=Y
+priority template ^D1$
+`))
+	suite.Require().NoError(err)
+	suite.Require().Len(rules, 3)
+
+	suite.Equal(RuleDrop, rules[0].Action)
+	suite.Equal(RuleFieldLine, rules[0].Field)
+	suite.Equal("heartbeat ok$", rules[0].Pattern.String())
+	suite.Equal(RuleQuarantine, rules[1].Action)
+	suite.Equal(RuleFieldMask, rules[1].Field)
+	suite.Equal(RulePriority, rules[2].Action)
+	suite.Equal(RuleFieldTemplate, rules[2].Field)
+}
+
+func (suite *RulesTestSuite) TestParseRulesErrors() {
+	testCases := []struct {
+		name     string
+		rules    string
+		expected string
+	}{
+		{"missing regex", "drop line", "rule line 1"},
+		{"unknown action", "ignore line x", `unknown action "ignore"`},
+		{"unknown field", "drop host x", `unknown field "host"`},
+		{"bad regex", "# comment\ndrop line (", "rule line 2"},
+	}
+
+	for _, tc := range testCases {
+		suite.Run(tc.name, func() {
+			_, err := ParseRules(strings.NewReader(tc.rules))
+			suite.ErrorContains(err, tc.expected)
+		})
+	}
+}
+
+func (suite *RulesTestSuite) TestMatchFirstRuleWins() {
+	rules, err := ParseRules(strings.NewReader("priority line pid\ndrop mask ^Y=Y$\n"))
+	suite.Require().NoError(err)
+
+	rule, matched := rules.Match(suite.helper.CreateTestSentence("pid=1702", []string{"pid", "1702"}, "Y=Y"))
+	suite.True(matched)
+	suite.Equal(RulePriority, rule.Action)
+
+	rule, matched = rules.Match(suite.helper.CreateTestSentence("uid=1000", []string{"uid", "1000"}, "Y=Y"))
+	suite.True(matched)
+	suite.Equal(RuleDrop, rule.Action)
+
+	_, matched = rules.Match(suite.helper.CreateTestSentence("started", []string{"started"}, "Y"))
+	suite.False(matched)
+}
+
+func (suite *RulesTestSuite) TestMatchTemplateID() {
+	sentence := suite.helper.CreateTestSentence("pid=1702", []string{"pid", "1702"}, "Y=Y")
+	rules, err := ParseRules(strings.NewReader("drop template ^" + sentence.Fingerprint.String() + "$\nquarantine template ^D7$\n"))
+	suite.Require().NoError(err)
+
+	rule, matched := rules.Match(sentence)
+	suite.True(matched)
+	suite.Equal(RuleDrop, rule.Action)
+
+	// Consumers with their own template IDs are matched on those
+	sentence.TemplateID = "D7"
+	rule, matched = rules.Match(sentence)
+	suite.True(matched)
+	suite.Equal(RuleQuarantine, rule.Action)
+}
+
+func (suite *RulesTestSuite) TestLoadRulesMissingFile() {
+	_, err := LoadRules(filepath.Join(suite.T().TempDir(), "missing.rules"))
+	suite.Error(err)
+}
+
+func TestRulesTestSuite(t *testing.T) {
+	suite.Run(t, new(RulesTestSuite))
+}
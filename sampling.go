@@ -0,0 +1,95 @@
+package main
+
+import (
+	"math/rand/v2"
+	"slices"
+	"time"
+)
+
+// SamplePolicy decides when a mask is contextualised and which of its lines are sent as samples.
+// Every mask keeps a uniform reservoir of its lines, and the samples are picked from it greedily so
+// that each one adds as many unseen token values per position as possible. Identical retries of a
+// line then only make it into the samples when nothing else is left.
+type SamplePolicy struct {
+	Threshold int           // Lines of a mask before it is contextualised
+	MaxWait   time.Duration // Contextualise a mask with fewer lines once it was first seen this long ago, 0 waits for the threshold
+	Flush     bool          // Contextualise masks with fewer lines at the end of the input, implied by MaxWait
+	Reservoir int           // Lines kept per mask to choose samples from
+	Samples   int           // Lines sent to the provider
+}
+
+var defaultSamplePolicy = SamplePolicy{
+	Threshold: keptSamples,
+	Reservoir: 16,
+	Samples:   keptSamples,
+}
+
+// keep adds the count-th line of a mask to its reservoir, replacing a random line once the
+// reservoir is full so that every line is kept with the same probability. The reservoir is copied
+// before a replacement as contextualisation may be reading it.
+func (p SamplePolicy) keep(reservoir []Sentence, count int, s Sentence) []Sentence {
+	size := max(p.Reservoir, 1)
+	if len(reservoir) < size {
+		return append(reservoir, s)
+	}
+
+	if j := rand.IntN(count); j < size {
+		reservoir = slices.Clone(reservoir)
+		reservoir[j] = s
+	}
+
+	return reservoir
+}
+
+// positionValues returns the token of every position of the folded mask
+func positionValues(s Sentence) []string {
+	values := make([]string, len(s.Tokens))
+	for i, token := range s.Tokens {
+		values[i] = string(token)
+	}
+
+	return FoldLabels(values, s.Repetitions)
+}
+
+// selectDiverse picks up to Samples lines of the reservoir. Each pick is the line with the most
+// positions holding a value no picked line has at that position, the earliest line on ties.
+func (p SamplePolicy) selectDiverse(reservoir []Sentence) []LogLine {
+	values := make([][]string, len(reservoir))
+	for i, s := range reservoir {
+		values[i] = positionValues(s)
+	}
+
+	var seen []map[string]bool
+	picked := make([]bool, len(reservoir))
+	var lines []LogLine
+	for len(lines) < max(p.Samples, 1) && len(lines) < len(reservoir) {
+		best, bestScore := -1, -1
+		for i := range reservoir {
+			if picked[i] {
+				continue
+			}
+
+			var score int
+			for position, value := range values[i] {
+				if position >= len(seen) || !seen[position][value] {
+					score++
+				}
+			}
+
+			if score > bestScore {
+				best, bestScore = i, score
+			}
+		}
+
+		picked[best] = true
+		lines = append(lines, reservoir[best].Line)
+		for position, value := range values[best] {
+			if position >= len(seen) {
+				seen = append(seen, make(map[string]bool))
+			}
+			seen[position][value] = true
+		}
+	}
+
+	return lines
+}
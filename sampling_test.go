@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// SamplePolicyTestSuite provides test suite for SamplePolicy
+type SamplePolicyTestSuite struct {
+	suite.Suite
+	consumer *MaskConsumer
+}
+
+func (suite *SamplePolicyTestSuite) SetupTest() {
+	suite.consumer = NewMaskConsumer()
+}
+
+func (suite *SamplePolicyTestSuite) sentences(lines ...string) []Sentence {
+	var sentences []Sentence
+	for _, line := range lines {
+		s, err := suite.consumer.Mask([]rune(line))
+		suite.Require().NoError(err)
+		sentences = append(sentences, s)
+	}
+
+	return sentences
+}
+
+func (suite *SamplePolicyTestSuite) TestSelectsDiverseLines() {
+	policy := SamplePolicy{Samples: 3}
+	reservoir := suite.sentences(
+		"retry job 7 failed",
+		"retry job 7 failed",
+		"retry job 7 failed",
+		"retry job 8 failed",
+		"start job 9 done",
+	)
+
+	lines := policy.selectDiverse(reservoir)
+
+	suite.Equal([]LogLine{LogLine("retry job 7 failed"), LogLine("start job 9 done"), LogLine("retry job 8 failed")}, lines)
+}
+
+func (suite *SamplePolicyTestSuite) TestSelectsEveryLineOfSmallReservoirs() {
+	policy := SamplePolicy{Samples: 3}
+	lines := policy.selectDiverse(suite.sentences("a b", "a b"))
+	suite.Len(lines, 2)
+}
+
+func (suite *SamplePolicyTestSuite) TestSelectsFoldedPositions() {
+	folding := NewMaskConsumer(WithRepetitionFolding())
+	var reservoir []Sentence
+	for _, line := range []string{"users a=1, b=2;", "users a=1, b=2, c=3;", "users d=4, e=5;"} {
+		s, err := folding.Mask([]rune(line))
+		suite.Require().NoError(err)
+		reservoir = append(reservoir, s)
+	}
+
+	lines := SamplePolicy{Samples: 2}.selectDiverse(reservoir)
+	suite.Equal([]LogLine{LogLine("users a=1, b=2;"), LogLine("users d=4, e=5;")}, lines)
+}
+
+func (suite *SamplePolicyTestSuite) TestReservoirIsBounded() {
+	policy := SamplePolicy{Reservoir: 4}
+	var reservoir []Sentence
+	sentences := suite.sentences("a 1", "a 2", "a 3", "a 4", "a 5", "a 6", "a 7", "a 8")
+	for i, s := range sentences {
+		reservoir = policy.keep(reservoir, i+1, s)
+	}
+
+	suite.Len(reservoir, 4)
+}
+
+func (suite *SamplePolicyTestSuite) TestReplacementDoesNotTouchSharedReservoir() {
+	policy := SamplePolicy{Reservoir: 1}
+	sentences := suite.sentences("a 1", "a 2")
+	reservoir := policy.keep(nil, 1, sentences[0])
+	shared := reservoir
+
+	// With one slot the second line replaces the first half of the time
+	for count := 2; count < 64; count++ {
+		reservoir = policy.keep(reservoir, count, sentences[1])
+	}
+
+	suite.Equal(LogLine("a 1"), shared[0].Line)
+}
+
+func TestSamplePolicyTestSuite(t *testing.T) {
+	suite.Run(t, new(SamplePolicyTestSuite))
+}
@@ -0,0 +1,72 @@
+package main
+
+import "sync"
+
+// Registered sentences can be labelled on several shards. Every mask is pinned to one shard by a
+// jump consistent hash of its fingerprint, so lines of a template keep their order within their
+// shard, and changing the shard count only moves the masks of the added or removed shards.
+
+// jumpHash maps a key to one of n buckets, see Lamping and Veach, "A Fast, Minimal Memory,
+// Consistent Hash Algorithm"
+func jumpHash(key uint64, n int) int {
+	var b, j int64 = -1, 0
+	for j < int64(n) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+
+	return int(b)
+}
+
+// ShardOf returns the shard of n labelling a mask
+func ShardOf(key Fingerprint, n int) int {
+	return jumpHash(uint64(key), n)
+}
+
+// Shard fans registered sentences out to n shards by mask fingerprint. The shards are closed once
+// registered is closed and drained.
+func (a *Admin) Shard(registered RegisteredChan, n int) []RegisteredChan {
+	shards := make([]RegisteredChan, n)
+	for i := range shards {
+		shards[i] = make(RegisteredChan, 100)
+	}
+
+	go func() {
+		defer func() {
+			for _, shard := range shards {
+				close(shard)
+			}
+		}()
+
+		for s := range registered {
+			shards[ShardOf(s.Fingerprint, n)] <- s
+		}
+	}()
+
+	return shards
+}
+
+// MergeLabelled merges the output of labeller shards into a single channel for the writers,
+// closed once every shard is closed
+func MergeLabelled(shards ...chan LabelledTokens) chan LabelledTokens {
+	output := make(chan LabelledTokens, 100)
+
+	var wg sync.WaitGroup
+	wg.Add(len(shards))
+	for _, shard := range shards {
+		go func() {
+			defer wg.Done()
+			for labelled := range shard {
+				output <- labelled
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(output)
+	}()
+
+	return output
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// ShardTestSuite provides test suite for labeller sharding
+type ShardTestSuite struct {
+	suite.Suite
+	admin  *Admin
+	helper *TestHelper
+}
+
+func (suite *ShardTestSuite) SetupTest() {
+	suite.admin = NewAdmin(NewMaskStatusStore(), NewContextStore(), NewTemplateStore(), NewSampleLineStore(), nil, &sync.WaitGroup{})
+	suite.helper = &TestHelper{}
+}
+
+func (suite *ShardTestSuite) TestJumpHashIsConsistent() {
+	// Growing from n to n+1 shards only moves keys to the new shard
+	for key := uint64(0); key < 1000; key++ {
+		for n := 1; n < 16; n++ {
+			before, after := jumpHash(key*0x9e3779b97f4a7c15, n), jumpHash(key*0x9e3779b97f4a7c15, n+1)
+			suite.True(before >= 0 && before < n)
+			suite.True(after == before || after == n)
+		}
+	}
+}
+
+func (suite *ShardTestSuite) TestJumpHashSpreadsKeys() {
+	counts := make([]int, 4)
+	for i := 0; i < 4000; i++ {
+		counts[ShardOf(FingerprintOf(LogMask(strconv.Itoa(i))), 4)]++
+	}
+
+	for _, count := range counts {
+		suite.Greater(count, 500)
+	}
+}
+
+func (suite *ShardTestSuite) TestShardKeepsTemplateOrder() {
+	registered := make(RegisteredChan, 100)
+	masks := []string{"Y Y", "Y=Y", "Y [X]", "Y: Y"}
+	for i := 0; i < 40; i++ {
+		line := string(rune('a' + i))
+		registered <- suite.helper.CreateTestSentence(line, []string{line}, masks[i%len(masks)])
+	}
+	close(registered)
+
+	shards := suite.admin.Shard(registered, 3)
+	suite.Len(shards, 3)
+
+	seen := make(map[Fingerprint][]string)
+	for i, shard := range shards {
+		for s := range shard {
+			suite.Equal(ShardOf(s.Fingerprint, 3), i)
+			seen[s.Fingerprint] = append(seen[s.Fingerprint], string(s.Line))
+		}
+	}
+
+	for i, mask := range masks {
+		var expected []string
+		for j := i; j < 40; j += len(masks) {
+			expected = append(expected, string(rune('a'+j)))
+		}
+		suite.Equal(expected, seen[FingerprintOf(LogMask(mask))])
+	}
+}
+
+func (suite *ShardTestSuite) TestMergeLabelledDrainsEveryShard() {
+	shards := make([]chan LabelledTokens, 3)
+	for i := range shards {
+		shards[i] = make(chan LabelledTokens, 2)
+		shards[i] <- LabelledTokens{}
+		shards[i] <- LabelledTokens{}
+		close(shards[i])
+	}
+
+	var count int
+	for range MergeLabelled(shards...) {
+		count++
+	}
+
+	suite.Equal(6, count)
+}
+
+func TestShardTestSuite(t *testing.T) {
+	suite.Run(t, new(ShardTestSuite))
+}
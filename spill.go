@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// SpillQueue keeps sentences that do not fit the in-memory backlog on disk, one append-only
+// segment per mask. Every record is a length prefixed gob of a single sentence, so a segment can
+// be appended to without holding a file open per mask.
+type SpillQueue struct {
+	dir string
+}
+
+// NewSpillQueue removes the segments an earlier run left in dir, as their masks belong to that
+// run and replaying them would mix its lines into this one
+func NewSpillQueue(dir string) (*SpillQueue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	for _, pattern := range []string{"*.spill", "*.spill.replay"} {
+		stale, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, segment := range stale {
+			if err := os.Remove(segment); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return &SpillQueue{dir: dir}, nil
+}
+
+func (q *SpillQueue) segment(key Fingerprint) string {
+	return filepath.Join(q.dir, key.String()+".spill")
+}
+
+// Append adds a sentence to the end of the mask's segment
+func (q *SpillQueue) Append(key Fingerprint, s Sentence) error {
+	var record bytes.Buffer
+	if err := gob.NewEncoder(&record).Encode(s); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(q.segment(key), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(record.Len()))
+	if _, err := file.Write(append(size[:], record.Bytes()...)); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// Take moves the mask's segment aside so it can be replayed while new sentences start a new
+// segment. Returns an empty path when nothing was spilled.
+func (q *SpillQueue) Take(key Fingerprint) (string, error) {
+	taken := q.segment(key) + ".replay"
+	err := os.Rename(q.segment(key), taken)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	return taken, nil
+}
+
+// readRecord reads the next sentence of a segment, io.EOF at its end
+func readRecord(reader *bufio.Reader) (Sentence, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(reader, size[:]); err != nil {
+		return Sentence{}, err
+	}
+
+	record := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(reader, record); err != nil {
+		return Sentence{}, err
+	}
+
+	var s Sentence
+	err := gob.NewDecoder(bytes.NewReader(record)).Decode(&s)
+	return s, err
+}
+
+// Peek returns up to n of the first sentences of the mask's segment without taking them. A
+// record still being appended ends the segment early.
+func (q *SpillQueue) Peek(key Fingerprint, n int) ([]Sentence, error) {
+	file, err := os.Open(q.segment(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var sentences []Sentence
+	for len(sentences) < n {
+		s, err := readRecord(reader)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+
+		if err != nil {
+			return sentences, err
+		}
+
+		sentences = append(sentences, s)
+	}
+
+	return sentences, nil
+}
+
+// Replay visits the sentences of a taken segment in the order they were appended and removes it
+func (q *SpillQueue) Replay(taken string, visit func(Sentence)) error {
+	file, err := os.Open(taken)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(taken)
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		s, err := readRecord(reader)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		visit(s)
+	}
+}
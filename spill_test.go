@@ -0,0 +1,120 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// SpillQueueTestSuite provides test suite for SpillQueue
+type SpillQueueTestSuite struct {
+	suite.Suite
+	queue  *SpillQueue
+	helper *TestHelper
+}
+
+func (suite *SpillQueueTestSuite) SetupTest() {
+	queue, err := NewSpillQueue(suite.T().TempDir())
+	suite.Require().NoError(err)
+	suite.queue = queue
+	suite.helper = &TestHelper{}
+}
+
+func (suite *SpillQueueTestSuite) TestReplaysInAppendOrder() {
+	first := suite.helper.CreateTestSentence("I started", []string{"I", "started"}, "Y Y")
+	second := suite.helper.CreateTestSentence("I stopped", []string{"I", "stopped"}, "Y Y")
+	key := first.Fingerprint
+
+	suite.NoError(suite.queue.Append(key, first))
+	suite.NoError(suite.queue.Append(key, second))
+
+	segment, err := suite.queue.Take(key)
+	suite.NoError(err)
+
+	var replayed []string
+	suite.NoError(suite.queue.Replay(segment, func(s Sentence) {
+		replayed = append(replayed, string(s.Line))
+	}))
+
+	suite.Equal([]string{"I started", "I stopped"}, replayed)
+
+	// Replayed segments are removed
+	_, err = os.Stat(segment)
+	suite.True(os.IsNotExist(err))
+}
+
+func (suite *SpillQueueTestSuite) TestTakeWithoutSegment() {
+	segment, err := suite.queue.Take(FingerprintOf(LogMask("Y Y")))
+	suite.NoError(err)
+	suite.Empty(segment)
+}
+
+func (suite *SpillQueueTestSuite) TestAppendAfterTakeStartsNewSegment() {
+	sentence := suite.helper.CreateTestSentence("I started", []string{"I", "started"}, "Y Y")
+	key := sentence.Fingerprint
+
+	suite.NoError(suite.queue.Append(key, sentence))
+	segment, err := suite.queue.Take(key)
+	suite.NoError(err)
+	suite.NoError(suite.queue.Append(key, sentence))
+
+	var replayed int
+	suite.NoError(suite.queue.Replay(segment, func(Sentence) { replayed++ }))
+	suite.Equal(1, replayed)
+
+	next, err := suite.queue.Take(key)
+	suite.NoError(err)
+	suite.NotEmpty(next)
+}
+
+func (suite *SpillQueueTestSuite) TestPeekLeavesSegment() {
+	first := suite.helper.CreateTestSentence("I started", []string{"I", "started"}, "Y Y")
+	second := suite.helper.CreateTestSentence("I stopped", []string{"I", "stopped"}, "Y Y")
+	key := first.Fingerprint
+
+	peeked, err := suite.queue.Peek(key, 1)
+	suite.NoError(err)
+	suite.Empty(peeked)
+
+	suite.NoError(suite.queue.Append(key, first))
+	suite.NoError(suite.queue.Append(key, second))
+
+	peeked, err = suite.queue.Peek(key, 1)
+	suite.NoError(err)
+	suite.Len(peeked, 1)
+	suite.Equal("I started", string(peeked[0].Line))
+
+	segment, err := suite.queue.Take(key)
+	suite.NoError(err)
+
+	var replayed int
+	suite.NoError(suite.queue.Replay(segment, func(Sentence) { replayed++ }))
+	suite.Equal(2, replayed)
+}
+
+func (suite *SpillQueueTestSuite) TestRemovesSegmentsOfEarlierRuns() {
+	sentence := suite.helper.CreateTestSentence("I started", []string{"I", "started"}, "Y Y")
+	key := sentence.Fingerprint
+
+	suite.NoError(suite.queue.Append(key, sentence))
+	_, err := suite.queue.Take(key)
+	suite.NoError(err)
+	suite.NoError(suite.queue.Append(key, sentence))
+
+	queue, err := NewSpillQueue(suite.queue.dir)
+	suite.Require().NoError(err)
+
+	left, err := filepath.Glob(filepath.Join(queue.dir, "*"))
+	suite.NoError(err)
+	suite.Empty(left)
+
+	segment, err := queue.Take(key)
+	suite.NoError(err)
+	suite.Empty(segment)
+}
+
+func TestSpillQueueTestSuite(t *testing.T) {
+	suite.Run(t, new(SpillQueueTestSuite))
+}
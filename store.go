@@ -5,11 +5,14 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"sync"
 )
 
+// Stores are keyed by mask fingerprints and safe for concurrent use
 type Store[T any] interface {
-	Get(key string) (T, error)
-	Put(key string, value T) error
+	Get(key Fingerprint) (T, error)
+	Put(key Fingerprint, value T) error
+	Update(key Fingerprint, update func(value T, exists bool) (T, bool)) (T, bool)
 	Reporter
 }
 
@@ -18,23 +21,34 @@ type Reporter interface {
 }
 
 type MemoryStore[T any] struct {
-	data map[string]T
+	mu      sync.RWMutex
+	data    map[Fingerprint]T
+	journal func(key Fingerprint, value T) error // Optional, called with every write while it is locked
 }
 
 func NewMemoryStore() *MemoryStore[bool] {
 	return &MemoryStore[bool]{
-		data: make(map[string]bool),
+		data: make(map[Fingerprint]bool),
 	}
 }
 
 func NewContextStore() *MemoryStore[Context] {
 	return &MemoryStore[Context]{
-		data: make(map[string]Context),
+		data: make(map[Fingerprint]Context),
 	}
 }
 
-func (m *MemoryStore[T]) Get(key string) (T, error) {
+// NewTemplateStore maps fingerprints back to the masks they were computed from
+func NewTemplateStore() *MemoryStore[LogMask] {
+	return &MemoryStore[LogMask]{
+		data: make(map[Fingerprint]LogMask),
+	}
+}
+
+func (m *MemoryStore[T]) Get(key Fingerprint) (T, error) {
+	m.mu.RLock()
 	value, exists := m.data[key]
+	m.mu.RUnlock()
 	if !exists {
 		var zero T
 		return zero, errors.New("key not found")
@@ -43,11 +57,62 @@ func (m *MemoryStore[T]) Get(key string) (T, error) {
 	return value, nil
 }
 
-func (m *MemoryStore[T]) Put(key string, value T) error {
+func (m *MemoryStore[T]) Put(key Fingerprint, value T) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	m.data[key] = value // Hardcoded for dev, remove in prod
+	if m.journal != nil {
+		return m.journal(key, value)
+	}
+
 	return nil
 }
 
+// Update atomically replaces the value of key with the result of update, which is given the
+// current value and whether it exists. Nothing is written when update returns false. Returns
+// the value held after the update and whether it was written.
+func (m *MemoryStore[T]) Update(key Fingerprint, update func(value T, exists bool) (T, bool)) (T, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current, exists := m.data[key]
+	value, write := update(current, exists)
+	if !write {
+		return current, false
+	}
+
+	m.data[key] = value
+	if m.journal != nil {
+		if err := m.journal(key, value); err != nil {
+			fmt.Printf("error journaling %s: %v\n", key, err)
+		}
+	}
+
+	return value, true
+}
+
+// CompareAndSet stores value when key currently holds old, a missing key never matches
+func CompareAndSet[T comparable](s Store[T], key Fingerprint, old T, value T) bool {
+	_, swapped := s.Update(key, func(current T, exists bool) (T, bool) {
+		return value, exists && current == old
+	})
+
+	return swapped
+}
+
+func (m *MemoryStore[T]) Keys() []Fingerprint {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	keys := make([]Fingerprint, 0, len(m.data))
+	for k := range m.data {
+		keys = append(keys, k)
+	}
+
+	return keys
+}
+
 func (m *MemoryStore[T]) Report(filename string) error {
 	file, err := os.Create(filename)
 	if err != nil {
@@ -58,8 +123,12 @@ func (m *MemoryStore[T]) Report(filename string) error {
 	writer := bufio.NewWriter(file)
 	defer writer.Flush()
 
-	for k := range m.data {
-		_, err := fmt.Fprint(writer, k+"\n")
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	// One entry per line, the template ID followed by its value
+	for k, v := range m.data {
+		_, err := fmt.Fprintf(writer, "%s\t%v\n", k, v)
 		if err != nil {
 			return err
 		}
@@ -5,12 +5,18 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 )
 
+// fp keys the stores with the fingerprint of a readable name
+func fp(name string) Fingerprint {
+	return FingerprintOf(LogMask(name))
+}
+
 // MemoryStoreTestSuite provides test suite for MemoryStore
 type MemoryStoreTestSuite struct {
 	suite.Suite
@@ -21,7 +27,7 @@ type MemoryStoreTestSuite struct {
 
 func (suite *MemoryStoreTestSuite) SetupTest() {
 	suite.store = &MemoryStore[string]{
-		data: make(map[string]string),
+		data: make(map[Fingerprint]string),
 	}
 	suite.boolStore = NewMemoryStore()
 	suite.helper = &TestHelper{}
@@ -29,17 +35,17 @@ func (suite *MemoryStoreTestSuite) SetupTest() {
 
 func (suite *MemoryStoreTestSuite) TestPutAndGet() {
 	// Test putting and getting a value
-	err := suite.store.Put("test-key", "test-value")
+	err := suite.store.Put(fp("test-key"), "test-value")
 	suite.NoError(err)
 
-	value, err := suite.store.Get("test-key")
+	value, err := suite.store.Get(fp("test-key"))
 	suite.NoError(err)
 	suite.Equal("test-value", value)
 }
 
 func (suite *MemoryStoreTestSuite) TestGetNonExistentKey() {
 	// Test getting a non-existent key returns error
-	value, err := suite.store.Get("non-existent")
+	value, err := suite.store.Get(fp("non-existent"))
 	suite.Error(err)
 	suite.Equal("", value) // Zero value for string
 	suite.Contains(err.Error(), "key not found")
@@ -47,10 +53,10 @@ func (suite *MemoryStoreTestSuite) TestGetNonExistentKey() {
 
 func (suite *MemoryStoreTestSuite) TestOverwriteValue() {
 	// Test overwriting an existing value
-	suite.store.Put("key", "original")
-	suite.store.Put("key", "updated")
+	suite.store.Put(fp("key"), "original")
+	suite.store.Put(fp("key"), "updated")
 
-	value, err := suite.store.Get("key")
+	value, err := suite.store.Get(fp("key"))
 	suite.NoError(err)
 	suite.Equal("updated", value)
 }
@@ -62,10 +68,10 @@ func (suite *MemoryStoreTestSuite) TestBoolStoreCreation() {
 	suite.NotNil(boolStore.data)
 
 	// Test putting and getting bool values
-	err := boolStore.Put("test", true)
+	err := boolStore.Put(fp("test"), true)
 	suite.NoError(err)
 
-	value, err := boolStore.Get("test")
+	value, err := boolStore.Get(fp("test"))
 	suite.NoError(err)
 	suite.True(value)
 }
@@ -78,19 +84,19 @@ func (suite *MemoryStoreTestSuite) TestContextStoreCreation() {
 
 	// Test putting and getting Context values
 	testContext := Context{labels: []string{"label1", "label2"}}
-	err := contextStore.Put("test-mask", testContext)
+	err := contextStore.Put(fp("test-mask"), testContext)
 	suite.NoError(err)
 
-	value, err := contextStore.Get("test-mask")
+	value, err := contextStore.Get(fp("test-mask"))
 	suite.NoError(err)
 	suite.Equal(testContext.labels, value.labels)
 }
 
 func (suite *MemoryStoreTestSuite) TestReportToFile() {
 	// Populate store with test data
-	suite.store.Put("key1", "value1")
-	suite.store.Put("key2", "value2")
-	suite.store.Put("key3", "value3")
+	suite.store.Put(fp("key1"), "value1")
+	suite.store.Put(fp("key2"), "value2")
+	suite.store.Put(fp("key3"), "value3")
 
 	// Create temp directory for test output
 	tmpDir, err := os.MkdirTemp("", "store_test_*")
@@ -108,9 +114,9 @@ func (suite *MemoryStoreTestSuite) TestReportToFile() {
 	suite.NoError(err)
 
 	contentStr := string(content)
-	suite.Contains(contentStr, "key1")
-	suite.Contains(contentStr, "key2")
-	suite.Contains(contentStr, "key3")
+	suite.Contains(contentStr, fp("key1").String()+"\tvalue1")
+	suite.Contains(contentStr, fp("key2").String()+"\tvalue2")
+	suite.Contains(contentStr, fp("key3").String()+"\tvalue3")
 
 	// Verify each key is on its own line
 	lines := strings.Split(strings.TrimSpace(contentStr), "\n")
@@ -148,7 +154,7 @@ func (suite *MemoryStoreTestSuite) TestConcurrentAccess() {
 		go func(index int) {
 			key := fmt.Sprintf("key-%d", index)
 			value := fmt.Sprintf("value-%d", index)
-			suite.store.Put(key, value)
+			suite.store.Put(fp(key), value)
 			done <- true
 		}(i)
 	}
@@ -163,12 +169,63 @@ func (suite *MemoryStoreTestSuite) TestConcurrentAccess() {
 		key := fmt.Sprintf("key-%d", i)
 		expectedValue := fmt.Sprintf("value-%d", i)
 
-		value, err := suite.store.Get(key)
+		value, err := suite.store.Get(fp(key))
 		suite.NoError(err)
 		suite.Equal(expectedValue, value)
 	}
 }
 
+func (suite *MemoryStoreTestSuite) TestUpdate() {
+	value, written := suite.store.Update(fp("key"), func(current string, exists bool) (string, bool) {
+		suite.False(exists)
+		return "first", true
+	})
+	suite.True(written)
+	suite.Equal("first", value)
+
+	value, written = suite.store.Update(fp("key"), func(current string, exists bool) (string, bool) {
+		suite.True(exists)
+		return "ignored", false
+	})
+	suite.False(written)
+	suite.Equal("first", value)
+}
+
+func (suite *MemoryStoreTestSuite) TestCompareAndSet() {
+	suite.False(CompareAndSet[bool](suite.boolStore, fp("mask"), false, true), "missing keys never match")
+
+	suite.NoError(suite.boolStore.Put(fp("mask"), false))
+	suite.True(CompareAndSet[bool](suite.boolStore, fp("mask"), false, true))
+	suite.False(CompareAndSet[bool](suite.boolStore, fp("mask"), false, true))
+
+	value, err := suite.boolStore.Get(fp("mask"))
+	suite.NoError(err)
+	suite.True(value)
+}
+
+func (suite *MemoryStoreTestSuite) TestConcurrentUpdates() {
+	counter := &MemoryStore[int]{data: make(map[Fingerprint]int)}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				counter.Update(fp("count"), func(current int, _ bool) (int, bool) {
+					return current + 1, true
+				})
+				counter.Keys()
+			}
+		}()
+	}
+	wg.Wait()
+
+	value, err := counter.Get(fp("count"))
+	suite.NoError(err)
+	suite.Equal(5000, value)
+}
+
 // Table-driven tests for edge cases
 func (suite *MemoryStoreTestSuite) TestEdgeCases() {
 	testCases := []struct {
@@ -187,13 +244,13 @@ func (suite *MemoryStoreTestSuite) TestEdgeCases() {
 
 	for _, tc := range testCases {
 		suite.Run(tc.name, func() {
-			err := suite.store.Put(tc.key, tc.value)
+			err := suite.store.Put(fp(tc.key), tc.value)
 			if tc.expectError {
 				suite.Error(err)
 			} else {
 				suite.NoError(err)
 
-				value, err := suite.store.Get(tc.key)
+				value, err := suite.store.Get(fp(tc.key))
 				suite.NoError(err)
 				suite.Equal(tc.value, value)
 			}
@@ -208,17 +265,17 @@ func TestMemoryStoreTestSuite(t *testing.T) {
 // Additional standalone tests using assert package
 func TestMemoryStoreStandalone(t *testing.T) {
 	store := &MemoryStore[int]{
-		data: make(map[string]int),
+		data: make(map[Fingerprint]int),
 	}
 
 	// Test integer type store
-	assert.NoError(t, store.Put("number", 42))
+	assert.NoError(t, store.Put(fp("number"), 42))
 
-	value, err := store.Get("number")
+	value, err := store.Get(fp("number"))
 	assert.NoError(t, err)
 	assert.Equal(t, 42, value)
 
 	// Test zero value for int
-	_, err = store.Get("missing")
+	_, err = store.Get(fp("missing"))
 	assert.Error(t, err)
 }
\ No newline at end of file
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// A line like `INFO request done {"status":200,"dur_ms":12}` masks to "Y Y Y {X}", hiding every
+// field of the payload in one token. Enclosed segments that are valid JSON objects, and logfmt
+// pairs at the end of a line, are parsed into fields so they can be labelled by name.
+
+// Field is a named value parsed out of the tokens First up to Last
+type Field struct {
+	Key   string // Dotted path for nested JSON values, the key name for logfmt pairs
+	Value string
+	First int // Index of the first token the value was parsed from
+	Last  int // Exclusive index of the last token the value was parsed from
+}
+
+// Fewer trailing pairs than this are left to pair extraction, as plenty of lines end in a single k=v
+const minLogfmtPairs = 2
+
+// ParseFields finds JSON objects and a logfmt tail in a masked sentence
+func ParseFields(s Sentence) []Field {
+	if len(s.Spans) != len(s.Tokens) {
+		return nil
+	}
+
+	var fields []Field
+	for i, span := range s.Spans {
+		if span.Start == 0 || span.End >= len(s.Line) || s.Line[span.Start-1] != '{' || s.Line[span.End] != '}' {
+			continue
+		}
+
+		fields = append(fields, jsonFields(s.Line[span.Start-1:span.End+1], i)...)
+	}
+
+	return append(fields, logfmtFields(s)...)
+}
+
+// jsonFields flattens an object into one field per leaf value
+func jsonFields(object []rune, token int) []Field {
+	decoder := json.NewDecoder(strings.NewReader(string(object)))
+	decoder.UseNumber()
+
+	var value map[string]any
+	if err := decoder.Decode(&value); err != nil {
+		return nil
+	}
+
+	var fields []Field
+	flattenJSON("", value, func(key string, leaf string) {
+		fields = append(fields, Field{Key: key, Value: leaf, First: token, Last: token + 1})
+	})
+
+	return fields
+}
+
+func flattenJSON(prefix string, value any, emit func(string, string)) {
+	join := func(key string) string {
+		if prefix == "" {
+			return key
+		}
+
+		return prefix + "." + key
+	}
+
+	switch v := value.(type) {
+	case map[string]any:
+		// Decoded maps have no order, sort keys so fields come out the same way every time
+		for _, key := range slices.Sorted(maps.Keys(v)) {
+			flattenJSON(join(key), v[key], emit)
+		}
+	case []any:
+		for i, item := range v {
+			flattenJSON(join(strconv.Itoa(i)), item, emit)
+		}
+	case string:
+		emit(prefix, v)
+	case nil:
+		emit(prefix, "null")
+	default:
+		emit(prefix, fmt.Sprint(v))
+	}
+}
+
+// logfmtItem is a whitespace separated item of a line, quotes keep spaces inside an item
+type logfmtItem struct {
+	start, end int
+}
+
+func splitLogfmt(line LogLine) []logfmtItem {
+	var items []logfmtItem
+	for i := 0; i < len(line); {
+		if line[i] == ' ' || line[i] == '\t' {
+			i++
+			continue
+		}
+
+		start := i
+		quoted := false
+		for ; i < len(line) && (quoted || (line[i] != ' ' && line[i] != '\t')); i++ {
+			switch {
+			case line[i] == '\\' && quoted:
+				i++
+			case line[i] == '"':
+				quoted = !quoted
+			}
+		}
+
+		items = append(items, logfmtItem{start: start, end: min(i, len(line))})
+	}
+
+	return items
+}
+
+// parseLogfmtPair returns the key, value and value offsets of a key=value item
+func parseLogfmtPair(line LogLine, item logfmtItem) (string, string, int, int, bool) {
+	equals := item.start
+	for equals < item.end && isKeyRune(line[equals]) {
+		equals++
+	}
+
+	if equals == item.start || equals == item.end || line[equals] != '=' {
+		return "", "", 0, 0, false
+	}
+
+	key := string(line[item.start:equals])
+	value := line[equals+1 : item.end]
+	if len(value) > 0 && value[0] == '"' {
+		unquoted, err := strconv.Unquote(string(value))
+		if err != nil {
+			return "", "", 0, 0, false
+		}
+
+		return key, unquoted, equals + 2, item.end - 1, true
+	}
+
+	if slices.Contains(value, '"') {
+		return "", "", 0, 0, false
+	}
+
+	return key, string(value), equals + 1, item.end, true
+}
+
+// logfmtFields parses the longest run of key=value items ending the line
+func logfmtFields(s Sentence) []Field {
+	items := splitLogfmt(s.Line)
+
+	var fields []Field
+	for i := len(items) - 1; i >= 0; i-- {
+		key, value, start, end, ok := parseLogfmtPair(s.Line, items[i])
+		if !ok {
+			break
+		}
+
+		first, last := coveredTokens(s.Spans, start, end)
+		fields = append(fields, Field{Key: key, Value: value, First: first, Last: last})
+	}
+
+	if len(fields) < minLogfmtPairs {
+		return nil
+	}
+
+	// Pairs were collected from the end of the line
+	slices.Reverse(fields)
+
+	return fields
+}
+
+// coveredTokens returns the range of tokens whose spans lie within start and end
+func coveredTokens(spans []Span, start int, end int) (int, int) {
+	first := 0
+	for first < len(spans) && spans[first].Start < start {
+		first++
+	}
+
+	last := first
+	for last < len(spans) && spans[last].End <= end {
+		last++
+	}
+
+	return first, last
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// StructuredTestSuite provides test suite for embedded JSON and logfmt parsing
+type StructuredTestSuite struct {
+	suite.Suite
+	consumer *MaskConsumer
+	helper   *TestHelper
+}
+
+func (suite *StructuredTestSuite) SetupTest() {
+	suite.consumer = NewMaskConsumer(WithStructuredFields())
+	suite.helper = &TestHelper{}
+}
+
+func (suite *StructuredTestSuite) TestParsesEmbeddedJSON() {
+	sentence, err := suite.consumer.Mask([]rune(`INFO request done {"status":200,"dur_ms":12,"req":{"id":"a1","tags":["x",null]}}`))
+	suite.NoError(err)
+
+	suite.Equal("Y Y Y {X}", string(sentence.Mask))
+	suite.Equal([]Field{
+		{Key: "dur_ms", Value: "12", First: 3, Last: 4},
+		{Key: "req.id", Value: "a1", First: 3, Last: 4},
+		{Key: "req.tags.0", Value: "x", First: 3, Last: 4},
+		{Key: "req.tags.1", Value: "null", First: 3, Last: 4},
+		{Key: "status", Value: "200", First: 3, Last: 4},
+	}, sentence.Fields)
+}
+
+func (suite *StructuredTestSuite) TestIgnoresInvalidJSON() {
+	sentence, err := suite.consumer.Mask([]rune("ws=WorkSource{10113} {not json}"))
+	suite.NoError(err)
+
+	suite.Empty(sentence.Fields)
+}
+
+func (suite *StructuredTestSuite) TestParsesLogfmtTail() {
+	sentence, err := suite.consumer.Mask([]rune(`12:00 GET /health status=200 msg="all good" at=2024-01-01T10:00:00Z`))
+	suite.NoError(err)
+
+	suite.Require().Len(sentence.Fields, 3)
+	suite.Equal(Field{Key: "status", Value: "200", First: 5, Last: 6}, sentence.Fields[0])
+	suite.Equal(Field{Key: "msg", Value: "all good", First: 7, Last: 8}, sentence.Fields[1])
+	suite.Equal("at", sentence.Fields[2].Key)
+	suite.Equal("2024-01-01T10:00:00Z", sentence.Fields[2].Value)
+	suite.Equal(len(sentence.Tokens), sentence.Fields[2].Last)
+}
+
+func (suite *StructuredTestSuite) TestSinglePairIsNotLogfmt() {
+	sentence, err := suite.consumer.Mask([]rune("request done status=200"))
+	suite.NoError(err)
+
+	suite.Empty(sentence.Fields)
+}
+
+func (suite *StructuredTestSuite) TestDisabledByDefault() {
+	sentence, err := NewMaskConsumer().Mask([]rune(`done {"status":200}`))
+	suite.NoError(err)
+
+	suite.Nil(sentence.Fields)
+}
+
+func (suite *StructuredTestSuite) TestLabellerEmitsFields() {
+	sentence, err := suite.consumer.Mask([]rune(`INFO done {"status":200}`))
+	suite.NoError(err)
+
+	labeller := NewTokenLabeller(NewContextStore())
+	context := suite.helper.CreateTestContext([]string{"level", "message", "payload"})
+
+	result, err := labeller.LabelTokens(context, sentence)
+	suite.NoError(err)
+	suite.Equal(map[string][]string{
+		"level":   {"INFO"},
+		"message": {"done"},
+		"status":  {"200"},
+	}, result.Values())
+}
+
+func (suite *StructuredTestSuite) TestLogfmtRecordsCarryTemplateID() {
+	sentence, err := suite.consumer.Mask([]rune("request done status=200 took=12"))
+	suite.NoError(err)
+
+	labeller := NewTokenLabeller(NewContextStore())
+	context := suite.helper.CreateTestContext([]string{"text", "text", "key", "status", "key", "took"})
+
+	result, err := labeller.LabelTokens(context, sentence)
+	suite.NoError(err)
+
+	record := result.Record()
+	suite.Equal(sentence.Fingerprint.String(), record[templateIDKey])
+	suite.Equal([]string{"200"}, record["status"])
+	suite.Equal([]string{"12"}, record["took"])
+}
+
+func TestStructuredTestSuite(t *testing.T) {
+	suite.Run(t, new(StructuredTestSuite))
+}
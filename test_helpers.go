@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
 )
 
 // TestHelper provides common utilities for tests
@@ -56,13 +59,86 @@ func (th *TestHelper) CreateTestSentence(line string, tokens []string, mask stri
 	}
 
 	return Sentence{
-		Tokens: runeTokens,
-		Mask:   []rune(mask),
-		Line:   []rune(line),
+		Tokens:      runeTokens,
+		Mask:        []rune(mask),
+		Line:        []rune(line),
+		Fingerprint: FingerprintOf([]rune(mask)),
 	}
 }
 
 // CreateTestContext creates a Context for testing purposes
 func (th *TestHelper) CreateTestContext(labels []string) Context {
 	return Context{labels: labels}
-}
\ No newline at end of file
+}
+
+// FakeContextProvider is an in-memory ContextProvider for tests. It answers with the labels set
+// for a mask and records every candidate it was asked about.
+type FakeContextProvider struct {
+	mu         sync.Mutex
+	labels     map[string][]string
+	err        error
+	responses  []fakeResponse
+	candidates []ContextCandidate
+}
+
+type fakeResponse struct {
+	labels []string
+	err    error
+}
+
+func NewFakeContextProvider() *FakeContextProvider {
+	return &FakeContextProvider{
+		labels: make(map[string][]string),
+	}
+}
+
+// SetLabels sets the labels returned for mask
+func (f *FakeContextProvider) SetLabels(mask string, labels []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.labels[mask] = labels
+}
+
+// SetError makes every call fail with err
+func (f *FakeContextProvider) SetError(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err = err
+}
+
+// Respond queues an answer for the next call, answered before the labels set per mask
+func (f *FakeContextProvider) Respond(labels []string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.responses = append(f.responses, fakeResponse{labels: labels, err: err})
+}
+
+func (f *FakeContextProvider) Contextualise(_ context.Context, candidate ContextCandidate) (Context, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.candidates = append(f.candidates, candidate)
+
+	if len(f.responses) > 0 {
+		response := f.responses[0]
+		f.responses = f.responses[1:]
+		return Context{labels: response.labels}, response.err
+	}
+
+	if f.err != nil {
+		return Context{}, f.err
+	}
+
+	labels, exists := f.labels[string(candidate.Mask)]
+	if !exists {
+		return Context{}, fmt.Errorf("no labels for mask %q", string(candidate.Mask))
+	}
+
+	return Context{labels: labels}, nil
+}
+
+// Candidates returns the candidates received so far
+func (f *FakeContextProvider) Candidates() []ContextCandidate {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]ContextCandidate(nil), f.candidates...)
+}
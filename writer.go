@@ -3,7 +3,9 @@ package main
 // TODO: Refactor with better abstraction and rename the structs!!
 import (
 	"bufio"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"os"
 	"strings"
 	"sync"
@@ -32,11 +34,11 @@ func (fe *FileBufferWriter) Write(in chan []rune) error {
 	}
 
 	go func() {
+		defer fe.wg.Done()
 		defer file.Close()
 
 		writer := bufio.NewWriter(file)
 		defer writer.Flush()
-		defer fe.wg.Done()
 
 		for line := range in {
 			for _, r := range line {
@@ -69,11 +71,11 @@ func (fw *FileIntWriter) Write(in chan [][]rune) error {
 	}
 
 	go func() {
+		defer fw.wg.Done()
 		defer file.Close()
 
 		writer := bufio.NewWriter(file)
 		defer writer.Flush()
-		defer fw.wg.Done()
 
 		for line := range in {
 			var sb strings.Builder
@@ -90,3 +92,42 @@ func (fw *FileIntWriter) Write(in chan [][]rune) error {
 
 	return nil
 }
+
+// LabelledJSONWriter writes every labelled line as one JSON object of labels to their values and
+// the template ID of the line
+type LabelledJSONWriter struct {
+	filePath string
+	wg       *sync.WaitGroup
+}
+
+func NewLabelledJSONWriter(filePath string, wg *sync.WaitGroup) *LabelledJSONWriter {
+	return &LabelledJSONWriter{
+		filePath: filePath,
+		wg:       wg,
+	}
+}
+
+func (lw *LabelledJSONWriter) Write(in chan LabelledTokens) error {
+	file, err := os.Create(lw.filePath)
+	if err != nil {
+		return errors.New("could not open output file")
+	}
+
+	go func() {
+		// Deferred calls run last in first out, so the output is flushed and closed before Done
+		defer lw.wg.Done()
+		defer file.Close()
+
+		writer := bufio.NewWriter(file)
+		defer writer.Flush()
+
+		encoder := json.NewEncoder(writer)
+		for labelled := range in {
+			if err := encoder.Encode(labelled.Record()); err != nil {
+				fmt.Println("could not write labelled tokens")
+			}
+		}
+	}()
+
+	return nil
+}
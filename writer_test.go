@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// WriterTestSuite provides test suite for the file writers
+type WriterTestSuite struct {
+	suite.Suite
+	dir string
+}
+
+func (suite *WriterTestSuite) SetupTest() {
+	suite.dir = suite.T().TempDir()
+}
+
+func (suite *WriterTestSuite) TestFileBufferWriterFlushesBeforeDone() {
+	path := filepath.Join(suite.dir, "lines.log")
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	in := make(chan []rune, 1)
+	suite.NoError(NewFileBufferWriter(path, &wg).Write(in))
+	for i := 0; i < 1000; i++ {
+		in <- []rune("quarantined line")
+	}
+	close(in)
+	wg.Wait()
+
+	content, err := os.ReadFile(path)
+	suite.NoError(err)
+	suite.Equal(strings.Repeat("quarantined line\n", 1000), string(content))
+}
+
+func (suite *WriterTestSuite) TestLabelledJSONWriterFlushesBeforeDone() {
+	path := filepath.Join(suite.dir, "labelled.jsonl")
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	in := make(chan LabelledTokens, 1)
+	suite.NoError(NewLabelledJSONWriter(path, &wg).Write(in))
+	for i := 0; i < 1000; i++ {
+		in <- LabelledTokens{data: map[TokenLabel][]Token{"pid": {Token("1702")}}, template: FingerprintOf(LogMask("Y=Y"))}
+	}
+	close(in)
+	wg.Wait()
+
+	content, err := os.ReadFile(path)
+	suite.NoError(err)
+	record := fmt.Sprintf(`{"pid":["1702"],"template_id":"%s"}`, FingerprintOf(LogMask("Y=Y")))
+	suite.Equal(strings.Repeat(record+"\n", 1000), string(content))
+}
+
+func TestWriterTestSuite(t *testing.T) {
+	suite.Run(t, new(WriterTestSuite))
+}